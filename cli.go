@@ -0,0 +1,162 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/kpfaulkner/lblight/pkg"
+	"io"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// version is set at build time with: go build -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+const usage = `Usage: lblight <command> [flags]
+
+Commands:
+  serve      run the load balancer (default if no command given)
+  validate   check a config file and print the resolved routing table
+  version    print the lblight version
+
+Run "lblight <command> -h" for the flags of each command.
+`
+
+// serveOptions are the command line flags for the serve command.
+type serveOptions struct {
+	configPath string
+	logFile    string
+	logLevel   string
+	listenAddr string
+}
+
+// defaultConfigPath is lblight.json unless overridden with LBLIGHT_CONFIG (eg. App Service sets it in web.config)
+func defaultConfigPath() string {
+	configPath := os.Getenv("LBLIGHT_CONFIG")
+	if configPath == "" {
+		configPath = "lblight.json"
+	}
+	return configPath
+}
+
+// runCommand parses the command line and runs the requested command. Returns the process exit code.
+func runCommand(args []string) int {
+
+	// no command (or just flags) means serve, so existing deployments (eg. web.config) keep working.
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+
+	switch command {
+	case "serve":
+		return serveCommand(args)
+	case "validate":
+		return validateCommand(args)
+	case "version":
+		fmt.Printf("lblight %s (%s)\n", version, runtime.Version())
+		return 0
+	case "help":
+		fmt.Print(usage)
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %s\n\n%s", command, usage)
+	return 2
+}
+
+func serveCommand(args []string) int {
+	var opts serveOptions
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.StringVar(&opts.configPath, "config", defaultConfigPath(), "config file (json, yaml or toml)")
+	fs.StringVar(&opts.logFile, "log-file", "lblight.log", "log file, - for stderr")
+	fs.StringVar(&opts.logLevel, "log-level", "info", "log level (debug, info, warn, error)")
+	fs.StringVar(&opts.listenAddr, "listen", "", "address to listen on (eg. :4000), overrides the config port")
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		return 2
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(stop)
+
+	err = serve(opts, stop)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lblight: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+func validateCommand(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: lblight validate [config]\n")
+	}
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		return 2
+	}
+
+	configPath := defaultConfigPath()
+	if fs.NArg() > 0 {
+		configPath = fs.Arg(0)
+	}
+
+	config, err := pkg.LoadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	lbl := pkg.NewLBLight(config.Port, config.TlsListener)
+	err = lbl.Reload(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	fmt.Printf("%s is valid\n\n", configPath)
+	printRoutingTable(os.Stdout, lbl.GetRouterInfo())
+	return 0
+}
+
+// printRoutingTable writes the routers and their backends as a table.
+func printRoutingTable(w io.Writer, routers []pkg.RouterInfo) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROUTER\tSELECTION\tPATHS\tHEADERS\tBACKEND\tMAXCONNECTIONS\tWEIGHT")
+	for _, router := range routers {
+		var headers []string
+		for header, val := range router.AcceptedHeaders {
+			headers = append(headers, fmt.Sprintf("%s=%s", header, val))
+		}
+		sort.Strings(headers)
+
+		routerColumns := fmt.Sprintf("%s\t%s\t%s\t%s", router.Name, router.SelectionMethod, strings.Join(router.AcceptedPaths, ","), strings.Join(headers, ","))
+		if len(router.Backends) == 0 {
+			fmt.Fprintf(tw, "%s\t(none)\t\n", routerColumns)
+			continue
+		}
+
+		for _, be := range router.Backends {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", routerColumns, be.Host, be.MaxConnections, be.Weight)
+
+			// only show router details on first line for each router.
+			routerColumns = "\t\t\t"
+		}
+	}
+	tw.Flush()
+}
@@ -1,86 +1,316 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/kpfaulkner/lblight/pkg"
 	log "github.com/sirupsen/logrus"
 	"os"
-	"strconv"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
 	"time"
 )
 
-func initLogging(logFile string) {
-	var file, err = os.OpenFile(logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+// initLogging sends logs to logFile ("-" for stderr) at logLevel (debug, info, warn etc).
+func initLogging(logFile string, logLevel string) error {
+	level, err := log.ParseLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+	log.SetFormatter(&log.TextFormatter{})
+
+	if logFile == "-" {
+		log.SetOutput(os.Stderr)
+		return nil
+	}
+
+	var file *os.File
+	file, err = os.OpenFile(logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		fmt.Println("Could Not Open Log File : " + err.Error())
+		return err
 	}
 	log.SetOutput(file)
-	log.SetFormatter(&log.TextFormatter{})
+	return nil
+}
+
+// reloadConfig reloads the config file and swaps the new routing table into lbl. If the new config
+// is bad then the current routing table is left alone. Returns the config now in use.
+func reloadConfig(lbl *pkg.LBLight, configPath string, currentConfig pkg.Config) pkg.Config {
+	config, err := pkg.LoadConfig(configPath)
+	if err != nil {
+		log.Errorf("Unable to reload config, keeping existing routes: %s", err.Error())
+		lbl.RecordConfigError(err)
+		return currentConfig
+	}
+
+	if config.Port != currentConfig.Port || config.TlsListener != currentConfig.TlsListener ||
+		config.CertCrtPath != currentConfig.CertCrtPath || config.CertKeyPath != currentConfig.CertKeyPath ||
+		config.MaxHeaderBytes != currentConfig.MaxHeaderBytes || !reflect.DeepEqual(config.ProxyProtocol, currentConfig.ProxyProtocol) {
+		log.Warnf("Listener settings changed in %s, these require a restart to take effect", configPath)
+	}
+
+	err = lbl.Reload(config)
+	if err != nil {
+		log.Errorf("Unable to reload config, keeping existing routes: %s", err.Error())
+		return currentConfig
+	}
+	log.Infof("Reloaded config from %s", configPath)
+
+	// listener settings aren't reloaded, so keep reporting them as changed until restart.
+	config.Port = currentConfig.Port
+	config.TlsListener = currentConfig.TlsListener
+	config.CertCrtPath = currentConfig.CertCrtPath
+	config.CertKeyPath = currentConfig.CertKeyPath
+	config.ProxyProtocol = currentConfig.ProxyProtocol
+	config.MaxHeaderBytes = currentConfig.MaxHeaderBytes
+	return config
 }
-func registerPaths(lbl *pkg.LBLight, config pkg.Config) {
 
-	for _, beConfig := range config.BackendRouterConfigs {
-		pathMap := make(map[string]bool)
-		for _, path := range beConfig.AcceptedPaths {
-			pathMap[path] = true
+// latestConfigModTime returns the most recent modification time of the config file and
+// any files it includes.
+func latestConfigModTime(configPath string, config pkg.Config) time.Time {
+	files, err := pkg.ResolveIncludes(configPath, config.Include)
+	if err != nil {
+		// include has gone missing. Report the main file so the reload reports the error.
+		files = nil
+	}
+
+	var latest time.Time
+	for _, file := range append(files, configPath) {
+		fi, err := os.Stat(file)
+		if err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
 		}
+	}
+	return latest
+}
 
-		// make header map later.
-		ber := pkg.NewBackendRouter(nil, pathMap, pkg.ParseBackendSelectionString(beConfig.SelectionMethod))
+// liveConfig is the config currently in use. watchConfig updates it after each reload.
+type liveConfig struct {
+	mux    sync.RWMutex
+	config pkg.Config
+}
+
+func newLiveConfig(config pkg.Config) *liveConfig {
+	return &liveConfig{config: config}
+}
 
-		// now add backends that the router will route to.
-		for _, bec := range beConfig.BackendConfigs {
-			// only ad if max connections > 0. (can use 0 to disable).
-			if bec.MaxConnections > 0 {
-				be := pkg.NewBackend(bec.Host, bec.Port, bec.MaxConnections)
-				ber.AddBackend(be)
+func (c *liveConfig) get() pkg.Config {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.config
+}
+
+func (c *liveConfig) set(config pkg.Config) {
+	c.mux.Lock()
+	c.config = config
+	c.mux.Unlock()
+}
+
+// watchConfig reloads the config whenever SIGHUP is received or (if configured) the modification time
+// of the config file (or any file it includes) changes.
+func watchConfig(lbl *pkg.LBLight, configPath string, live *liveConfig) {
+	config := live.get()
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	// ConfigWatchTimerInSeconds can be changed by a reload, so the ticker is replaced whenever it changes.
+	var ticker *time.Ticker
+	var fileChanged <-chan time.Time
+	watchSeconds := 0
+	updateWatchTimer := func() {
+		if config.ConfigWatchTimerInSeconds == watchSeconds {
+			return
+		}
+		if ticker != nil {
+			ticker.Stop()
+		}
+		ticker, fileChanged = nil, nil
+		watchSeconds = config.ConfigWatchTimerInSeconds
+		if watchSeconds > 0 {
+			ticker = time.NewTicker(time.Duration(watchSeconds) * time.Second)
+			fileChanged = ticker.C
+		}
+	}
+	updateWatchTimer()
+
+	lastModTime := latestConfigModTime(configPath, config)
+	for {
+		select {
+		case <-sighup:
+			log.Infof("SIGHUP received, reloading config")
+		case <-fileChanged:
+			modTime := latestConfigModTime(configPath, config)
+			if modTime.Equal(lastModTime) {
+				continue
 			}
+			lastModTime = modTime
+			log.Infof("Config file %s changed, reloading config", configPath)
 		}
 
-		lbl.AddBackendRouter(ber)
+		config = reloadConfig(lbl, configPath, config)
+		live.set(config)
+		updateWatchTimer()
 	}
 }
 
-func main() {
+// serve runs LBLight until the listener fails or a signal (SIGTERM/SIGINT) is received on stop.
+func serve(opts serveOptions, stop <-chan os.Signal) error {
 
 	//defer profile.Start(profile.CPUProfile, profile.ProfilePath(".")).Stop()
 	//defer profile.Start(profile.MemProfile, profile.ProfilePath(".")).Stop()
 	//defer profile.Start(profile.TraceProfile, profile.ProfilePath(".")).Stop()
 
-	initLogging("lblight.log")
-	var config pkg.Config
+	err := initLogging(opts.logFile, opts.logLevel)
+	if err != nil {
+		return err
+	}
 
-	var port int
-	portStr := os.Getenv("HTTP_PLATFORM_PORT")
-	if portStr == "" {
-		config = pkg.LoadConfig("lblight.json")
-		port = config.Port
-	} else {
-		port, _ = strconv.Atoi(portStr)
-		config = pkg.LoadConfig("d:/home/site/wwwroot/lblight.json")
+	log.Infof("lblight %s starting", version)
+	config, err := pkg.LoadConfig(opts.configPath)
+	if err != nil {
+		log.Errorf("Unable to load config: %s", err.Error())
+		return err
 	}
 
-	log.Infof("port is %d", port)
-	lbl := pkg.NewLBLight(port, config.TlsListener)
+	lbl := pkg.NewLBLight(config.Port, config.TlsListener)
+	if opts.listenAddr != "" {
+		lbl.SetListenAddress(opts.listenAddr)
+	}
 
-	registerPaths(lbl, config)
+	lbl.SetMaxHeaderBytes(config.MaxHeaderBytes)
 
-	go func() {
-		for {
-			lbl.GetBackendStats()
-			<-time.After(5 * time.Second)
+	err = lbl.SetProxyProtocol(config.ProxyProtocol)
+	if err != nil {
+		log.Errorf("Unable to set up PROXY protocol: %s", err.Error())
+		return err
+	}
+
+	err = lbl.Reload(config)
+	if err != nil {
+		log.Errorf("Unable to configure backend routers: %s", err.Error())
+		return err
+	}
+
+	accessLog, err := pkg.NewAccessLogger(config.AccessLog)
+	if err != nil {
+		log.Errorf("Unable to set up access log: %s", err.Error())
+		return err
+	}
+	lbl.SetAccessLogger(accessLog)
+
+	tp, err := pkg.NewTracerProvider(config.Tracing)
+	if err != nil {
+		log.Errorf("Unable to set up tracing: %s", err.Error())
+		return err
+	}
+	if tp != nil {
+		lbl.SetTracerProvider(tp)
+		defer tp.Shutdown(context.Background())
+	}
+
+	live := newLiveConfig(config)
+	go watchConfig(lbl, opts.configPath, live)
+
+	// the admin API serves /metrics and the health probes, so don't run without it. Opened before the
+	// traffic listener so nothing is left accepting connections if it fails.
+	var admin *pkg.AdminServer
+	if config.AdminPort > 0 {
+		admin = pkg.NewAdminServer(lbl, config.AdminPort, config.AdminToken)
+		err = admin.Listen()
+		if err != nil {
+			return fmt.Errorf("Unable to start admin API on port %d : %s", config.AdminPort, err.Error())
 		}
-	}()
+	}
+
+	err = lbl.ListenTraffic()
+	if err != nil {
+		return err
+	}
+
+	if admin != nil {
+		go admin.Serve()
+	}
+
+	// all listeners are open, so if this process was started to take over from another it can go now.
+	pkg.CloseUnusedInheritedListeners()
+	notifyUpgradeParent()
+	go watchUpgrade(lbl)
+	sdNotify(pkg.SdReadyState())
+	go sdWatchdog()
 
 	go func() {
 		for {
 			lbl.CheckHealthOfAllBackendRouters()
-			<-time.After(time.Duration(config.HealthCheckTimerInSeconds) * time.Second)
+			// re-read each time, so a reload can change it.
+			<-time.After(time.Duration(live.get().GetHealthCheckTimerInSeconds()) * time.Second)
 		}
 	}()
 
-	err := lbl.ListenAndServeTraffic(config.CertCrtPath, config.CertKeyPath)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- lbl.ServeTraffic(config.CertCrtPath, config.CertKeyPath)
+	}()
+
+	select {
+	case err = <-serveErr:
+		if err != nil {
+			log.Errorf("LBLight exiting with error %s", err.Error())
+		}
+		return err
+	case sig := <-stop:
+		log.Infof("%s received, shutting down", sig)
+	}
+
+	// use the settings from the latest reload, not the ones loaded at startup.
+	shutdown(lbl, live.get())
+	return <-serveErr
+}
+
+// shutdown fails readiness, gives the load balancer in front ShutdownDelayInSeconds to notice, then
+// stops accepting connections and drains in-flight requests for up to ShutdownTimeoutInSeconds.
+func shutdown(lbl *pkg.LBLight, config pkg.Config) {
+	sdNotify(pkg.SdNotifyStopping)
+	lbl.StartDraining()
+	if config.ShutdownDelayInSeconds > 0 {
+		log.Infof("Not ready, waiting %d seconds before closing listener", config.ShutdownDelayInSeconds)
+		<-time.After(time.Duration(config.ShutdownDelayInSeconds) * time.Second)
+	}
+
+	timeout := config.ShutdownTimeoutInSeconds
+	if timeout == 0 {
+		timeout = pkg.DefaultShutdownTimeoutInSeconds
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	lbl.Shutdown(ctx)
+}
+
+// sdNotify tells systemd about a change of state, if running under systemd.
+func sdNotify(state string) {
+	_, err := pkg.SdNotify(state)
 	if err != nil {
-		log.Fatalf("LBLight exiting with error %s", err.Error())
+		log.Warnf("Unable to notify systemd : %s", err.Error())
+	}
+}
+
+// sdWatchdog keeps the systemd watchdog happy, if WatchdogSec= is set for the service.
+func sdWatchdog() {
+	interval := pkg.SdWatchdogInterval()
+	if interval == 0 {
+		return
 	}
+
+	log.Infof("Sending systemd watchdog every %s", interval)
+	for range time.Tick(interval) {
+		sdNotify(pkg.SdNotifyWatchdog)
+	}
+}
+
+func main() {
+	os.Exit(runCommand(os.Args[1:]))
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "secret"
+
+// writeTestConfig writes a config with a router for each of paths, all pointing at backendURL.
+func writeTestConfig(t *testing.T, configPath string, adminPort int, shutdownDelay int, backendURL string, paths ...string) {
+	var routers []map[string]interface{}
+	for _, path := range paths {
+		routers = append(routers, map[string]interface{}{
+			"AcceptedPaths":  []string{path},
+			"BackendConfigs": []map[string]interface{}{{"host": backendURL, "maxconnections": 10}},
+		})
+	}
+	config := map[string]interface{}{
+		"Port":                      4000,
+		"HealthCheckTimerInSeconds": 1,
+		"ConfigWatchTimerInSeconds": 1,
+		"ShutdownDelayInSeconds":    shutdownDelay,
+		"ShutdownTimeoutInSeconds":  1,
+		"AdminPort":                 adminPort,
+		"AdminToken":                testAdminToken,
+		"BackendRouterConfigs":      routers,
+	}
+	contents, err := json.Marshal(config)
+	assert.Nil(t, err, "Error not expected")
+	err = ioutil.WriteFile(configPath, contents, 0644)
+	assert.Nil(t, err, "Error not expected")
+}
+
+// freePort returns a port nothing is listening on.
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", ":0")
+	assert.Nil(t, err, "Error not expected")
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	return port
+}
+
+// adminGet sends an authorised GET to the admin API, returning the status and body (0 if it couldn't connect).
+func adminGet(port int, path string) (int, string) {
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d%s", port, path), nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, ""
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestServeFailsWhenAdminPortUnavailable(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	inUse, err := net.Listen("tcp", ":0")
+	assert.Nil(t, err, "Error not expected")
+	defer inUse.Close()
+
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "lblight.json")
+	writeTestConfig(t, configPath, inUse.Addr().(*net.TCPAddr).Port, 0, backend.URL, "/foo")
+
+	exited := make(chan int, 1)
+	go func() {
+		exited <- runCommand([]string{"serve", "-config", configPath, "-log-file", filepath.Join(dir, "lblight.log"), "-listen", "127.0.0.1:0"})
+	}()
+
+	select {
+	case exitCode := <-exited:
+		assert.Equal(t, 1, exitCode, "Expected serve to fail when the admin API can't listen")
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected serve to exit when the admin API can't listen")
+	}
+}
+
+func TestShutdownUsesReloadedSettings(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "lblight.json")
+	adminPort := freePort(t)
+	writeTestConfig(t, configPath, adminPort, 0, backend.URL, "/foo")
+
+	stop := make(chan os.Signal, 1)
+	exited := make(chan error, 1)
+	go func() {
+		exited <- serve(serveOptions{configPath: configPath, logFile: filepath.Join(dir, "lblight.log"), logLevel: "info", listenAddr: "127.0.0.1:0"}, stop)
+	}()
+
+	assert.Eventually(t, func() bool {
+		status, _ := adminGet(adminPort, "/readyz")
+		return status == http.StatusOK
+	}, 10*time.Second, 50*time.Millisecond, "Expected lblight to become ready")
+
+	// reload with a shutdown delay, and a new router to show the reload has happened.
+	writeTestConfig(t, configPath, adminPort, 2, backend.URL, "/foo", "/reloaded")
+	future := time.Now().Add(time.Minute)
+	err := os.Chtimes(configPath, future, future)
+	assert.Nil(t, err, "Error not expected")
+	assert.Eventually(t, func() bool {
+		_, body := adminGet(adminPort, "/routers")
+		return strings.Contains(body, "/reloaded")
+	}, 10*time.Second, 50*time.Millisecond, "Expected config to be reloaded")
+
+	start := time.Now()
+	stop <- syscall.SIGTERM
+
+	select {
+	case <-exited:
+		t.Fatalf("Expected shutdown to wait for the reloaded ShutdownDelayInSeconds")
+	case <-time.After(time.Second):
+	}
+	status, _ := adminGet(adminPort, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status, "Expected not ready during shutdown delay")
+
+	select {
+	case err = <-exited:
+		assert.Nil(t, err, "Error not expected")
+		assert.True(t, time.Since(start) >= 2*time.Second, "Expected shutdown after the reloaded delay")
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected lblight to shut down")
+	}
+}
@@ -0,0 +1,191 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AccessLogCommon   string = "common"
+	AccessLogCombined string = "combined"
+	AccessLogJSON     string = "json"
+)
+
+// AccessLogConfig configures the per request access log.
+type AccessLogConfig struct {
+	// file to write to, - for stdout. Empty disables the access log.
+	Path string `json:"path"`
+
+	// common, combined or json. Defaults to combined.
+	Format string `json:"format,omitempty"`
+
+	// rotation (ignored for stdout). Rotates when the file reaches MaxSizeInMB (default 100),
+	// keeps at most MaxBackups old files for MaxAgeInDays (0 means keep them all).
+	MaxSizeInMB  int  `json:"maxsizeinmb,omitempty"`
+	MaxBackups   int  `json:"maxbackups,omitempty"`
+	MaxAgeInDays int  `json:"maxageindays,omitempty"`
+	Compress     bool `json:"compress,omitempty"`
+
+	// fraction of requests (0-1) to log. 0 (not set) logs everything.
+	SampleRate float64 `json:"samplerate,omitempty"`
+}
+
+// Validate checks the access log config.
+func (c AccessLogConfig) Validate() error {
+	switch strings.ToLower(c.Format) {
+	case "", AccessLogCommon, AccessLogCombined, AccessLogJSON:
+	default:
+		return fmt.Errorf("Unknown access log format %s", c.Format)
+	}
+
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("Access log samplerate must be between 0 and 1")
+	}
+	return nil
+}
+
+// accessLogEntry is everything recorded about a single request.
+type accessLogEntry struct {
+	Time            time.Time `json:"time"`
+	RequestID       string    `json:"request_id"`
+	ClientIP        string    `json:"client_ip"`
+	User            string    `json:"user,omitempty"`
+	Method          string    `json:"method"`
+	URI             string    `json:"uri"`
+	Proto           string    `json:"proto"`
+	Host            string    `json:"host"`
+	Status          int       `json:"status"`
+	BytesIn         int64     `json:"bytes_in"`
+	BytesOut        int64     `json:"bytes_out"`
+	Router          string    `json:"router,omitempty"`
+	Backend         string    `json:"backend,omitempty"`
+	UpstreamLatency float64   `json:"upstream_latency_ms"`
+	TotalLatency    float64   `json:"total_latency_ms"`
+	Retries         int       `json:"retries"`
+	Referer         string    `json:"referer,omitempty"`
+	UserAgent       string    `json:"user_agent,omitempty"`
+}
+
+// AccessLogger writes an entry per request in Common/Combined Log Format or JSON.
+type AccessLogger struct {
+	format     string
+	sampleRate float64
+
+	out    io.Writer
+	outMux sync.Mutex
+}
+
+// NewAccessLogger creates an AccessLogger from config. Returns nil (and no error) if the access log
+// is not configured.
+func NewAccessLogger(config AccessLogConfig) (*AccessLogger, error) {
+	if config.Path == "" {
+		return nil, nil
+	}
+
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	al := AccessLogger{}
+	al.format = strings.ToLower(config.Format)
+	if al.format == "" {
+		al.format = AccessLogCombined
+	}
+
+	al.sampleRate = config.SampleRate
+	if al.sampleRate == 0 {
+		al.sampleRate = 1
+	}
+
+	if config.Path == "-" {
+		al.out = os.Stdout
+	} else {
+		al.out = &lumberjack.Logger{
+			Filename:   config.Path,
+			MaxSize:    config.MaxSizeInMB,
+			MaxBackups: config.MaxBackups,
+			MaxAge:     config.MaxAgeInDays,
+			Compress:   config.Compress,
+		}
+	}
+	return &al, nil
+}
+
+// log writes the access log entry for a completed request.
+func (al *AccessLogger) log(req *http.Request, rr *responseRecorder, info *requestInfo, bytesIn int64) {
+	if al.sampleRate < 1 && rand.Float64() >= al.sampleRate {
+		return
+	}
+
+	entry := accessLogEntry{Time: info.startTime, RequestID: info.requestID, Method: req.Method, URI: req.RequestURI, Proto: req.Proto, Host: req.Host}
+	entry.ClientIP, _, _ = net.SplitHostPort(req.RemoteAddr)
+	if entry.ClientIP == "" {
+		entry.ClientIP = req.RemoteAddr
+	}
+	if req.URL.User != nil {
+		entry.User = req.URL.User.Username()
+	}
+	entry.Status = rr.Status()
+	entry.BytesIn = bytesIn
+	entry.BytesOut = rr.Bytes()
+	entry.Router = info.routerName()
+	entry.Backend = info.backendHost()
+	entry.UpstreamLatency = float64(info.getUpstreamLatency().Microseconds()) / 1000
+	entry.TotalLatency = float64(time.Since(info.startTime).Microseconds()) / 1000
+	entry.Retries = info.retries
+	entry.Referer = req.Referer()
+	entry.UserAgent = req.UserAgent()
+
+	var line []byte
+	if al.format == AccessLogJSON {
+		line, _ = json.Marshal(entry)
+		line = append(line, '\n')
+	} else {
+		line = []byte(formatCLF(entry, al.format == AccessLogCombined))
+	}
+
+	al.outMux.Lock()
+	defer al.outMux.Unlock()
+	al.out.Write(line)
+}
+
+// formatCLF formats the entry as Common Log Format (or Combined if combined is true), with
+// the LBLight specific fields appended as key=value pairs.
+func formatCLF(entry accessLogEntry, combined bool) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s - %s [%s] \"%s %s %s\" %d %s", entry.ClientIP, clfField(entry.User), entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method, entry.URI, entry.Proto, entry.Status, clfBytes(entry.BytesOut))
+
+	if combined {
+		fmt.Fprintf(&sb, " %q %q", clfField(entry.Referer), clfField(entry.UserAgent))
+	}
+
+	fmt.Fprintf(&sb, " request_id=%q router=%q backend=%q upstream_ms=%.3f total_ms=%.3f retries=%d bytes_in=%d\n", entry.RequestID, entry.Router,
+		entry.Backend, entry.UpstreamLatency, entry.TotalLatency, entry.Retries, entry.BytesIn)
+	return sb.String()
+}
+
+// clfField returns - for empty fields, as per CLF.
+func clfField(val string) string {
+	if val == "" {
+		return "-"
+	}
+	return val
+}
+
+func clfBytes(bytes int64) string {
+	if bytes == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d", bytes)
+}
@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func generateTestAccessLogger(t *testing.T, format string, out *bytes.Buffer) *AccessLogger {
+	al, err := NewAccessLogger(AccessLogConfig{Path: "-", Format: format})
+	assert.Nil(t, err, "Error not expected")
+	al.out = out
+	return al
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	var out bytes.Buffer
+	lbl := generateTestLBLight(t, backend.URL)
+	lbl.SetAccessLogger(generateTestAccessLogger(t, AccessLogJSON, &out))
+
+	res := httptest.NewRecorder()
+	lbl.handleRequestsAndRedirect(res, httptest.NewRequest(http.MethodPost, "/foo/bar", strings.NewReader("request body")))
+
+	var entry accessLogEntry
+	err := json.Unmarshal(out.Bytes(), &entry)
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, http.StatusOK, entry.Status)
+	assert.Equal(t, "/foo", entry.Router)
+	assert.Equal(t, backend.URL, entry.Backend)
+	assert.Equal(t, int64(12), entry.BytesIn)
+	assert.Equal(t, int64(5), entry.BytesOut)
+	assert.Equal(t, "/foo/bar", entry.URI)
+	assert.True(t, entry.TotalLatency >= entry.UpstreamLatency, "Total latency should include upstream latency")
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	var out bytes.Buffer
+	lbl := generateTestLBLight(t, "http://127.0.0.1:1")
+	lbl.SetAccessLogger(generateTestAccessLogger(t, AccessLogCombined, &out))
+
+	req := httptest.NewRequest(http.MethodGet, "/nothere", nil)
+	req.Header.Set("User-Agent", "testagent")
+	lbl.handleRequestsAndRedirect(httptest.NewRecorder(), req)
+
+	line := out.String()
+	assert.True(t, strings.HasPrefix(line, "192.0.2.1 - - ["), fmt.Sprintf("Unexpected line %s", line))
+	assert.Contains(t, line, `"GET /nothere HTTP/1.1" 404 10 "-" "testagent" request_id="`)
+	assert.Contains(t, line, `router="" backend=""`)
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	var out bytes.Buffer
+	al := generateTestAccessLogger(t, AccessLogCommon, &out)
+	al.sampleRate = 0.0000001
+
+	lbl := generateTestLBLight(t, "http://127.0.0.1:1")
+	lbl.SetAccessLogger(al)
+	lbl.handleRequestsAndRedirect(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nothere", nil))
+	assert.Equal(t, 0, out.Len())
+}
+
+func TestAccessLogConfigValidation(t *testing.T) {
+	_, err := NewAccessLogger(AccessLogConfig{Path: "-", Format: "xml"})
+	assert.NotNil(t, err, "Expected unknown format error")
+
+	al, err := NewAccessLogger(AccessLogConfig{})
+	assert.Nil(t, err, "Error not expected")
+	assert.Nil(t, al, "No access logger expected when no path configured")
+}
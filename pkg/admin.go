@@ -0,0 +1,257 @@
+package pkg
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AdminServer is an HTTP API for inspecting and changing a running LBLight without a restart.
+// It listens on its own port and every request must have an "Authorization: Bearer <token>" header.
+// The exceptions are /metrics (Prometheus metrics), /healthz and /readyz which don't need the token.
+//
+//	GET    /routers                          list all routers and their backends
+//	GET    /routers/{router}                 single router
+//	POST   /routers/{router}/backends        add backend, body is a BackendConfig
+//	PATCH  /routers/{router}/backends/{host} change weight and/or state, body is backendUpdate
+//	DELETE /routers/{router}/backends/{host} remove backend
+//
+// Router names and backend hosts need to be URL path escaped (eg. /foo is %2Ffoo).
+// Changes are made to the live routers, but are not written back to the config. A config reload
+// replaces any backends added/removed here with whatever is in the config.
+type AdminServer struct {
+	lbl      *LBLight
+	port     int
+	token    string
+	listener net.Listener
+}
+
+// backendUpdate is the body for PATCH requests. Only fields that are set are changed.
+type backendUpdate struct {
+	Weight *int    `json:"weight,omitempty"`
+	State  *string `json:"state,omitempty"`
+}
+
+func NewAdminServer(lbl *LBLight, port int, token string) *AdminServer {
+	a := AdminServer{}
+	a.lbl = lbl
+	a.port = port
+	a.token = token
+	return &a
+}
+
+// ServeHTTP routes admin requests. Not using http.ServeMux since it "cleans" paths, which breaks
+// escaped router names such as %2Ffoo.
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	switch {
+	case path == "/metrics":
+		// not behind auth, so Prometheus can scrape it.
+		a.lbl.MetricsHandler().ServeHTTP(w, r)
+	case path == "/healthz":
+		// not behind auth, so orchestrators can probe it.
+		a.lbl.HealthzHandler().ServeHTTP(w, r)
+	case path == "/readyz":
+		a.lbl.ReadyzHandler().ServeHTTP(w, r)
+	case path == "/routers" || strings.HasPrefix(path, "/routers/"):
+		a.requireAuth(a.handleRouters)(w, r)
+	default:
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("Unknown admin request %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// ListenAndServe runs the admin API until it fails.
+func (a *AdminServer) ListenAndServe() error {
+	err := a.Listen()
+	if err != nil {
+		return err
+	}
+	return a.Serve()
+}
+
+// Listen opens (or takes over from a previous process) the admin listener.
+func (a *AdminServer) Listen() error {
+	listener, err := listen(adminListenerName, fmt.Sprintf(":%d", a.port))
+	if err != nil {
+		log.Errorf("Admin API unable to listen on port %d : %s", a.port, err.Error())
+		return err
+	}
+	a.listener = listener
+	return nil
+}
+
+// Serve runs the admin API on the listener opened by Listen until it fails.
+func (a *AdminServer) Serve() error {
+	log.Infof("Admin API listening on port %d", a.port)
+	err := http.Serve(a.listener, a)
+	if err != nil {
+		log.Errorf("Admin API exited: %s", err.Error())
+	}
+	return err
+}
+
+// requireAuth rejects any request that doesn't have the admin token.
+func (a *AdminServer) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if a.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminError(w, http.StatusUnauthorized, fmt.Errorf("Unauthorized"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleRouters dispatches everything under /routers based on the path segments.
+func (a *AdminServer) handleRouters(w http.ResponseWriter, r *http.Request) {
+
+	var segments []string
+	for _, segment := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		segments = append(segments, unescaped)
+	}
+
+	switch {
+	case len(segments) == 1 && r.Method == http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, a.lbl.GetRouterInfo())
+
+	case len(segments) == 2 && r.Method == http.MethodGet:
+		ber, err := a.lbl.GetBackendRouterByName(segments[1])
+		if err != nil {
+			writeAdminError(w, http.StatusNotFound, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, ber.getInfo())
+
+	case len(segments) == 3 && segments[2] == "backends" && r.Method == http.MethodPost:
+		a.addBackend(w, r, segments[1])
+
+	case len(segments) == 4 && segments[2] == "backends" && r.Method == http.MethodPatch:
+		a.updateBackend(w, r, segments[1], segments[3])
+
+	case len(segments) == 4 && segments[2] == "backends" && r.Method == http.MethodDelete:
+		ber, err := a.lbl.GetBackendRouterByName(segments[1])
+		if err == nil {
+			err = ber.RemoveBackend(segments[3])
+		}
+		if err != nil {
+			writeAdminError(w, http.StatusNotFound, err)
+			return
+		}
+		log.Infof("Admin API: removed backend %s from router %s", segments[3], ber.Name)
+		writeAdminJSON(w, http.StatusOK, ber.getInfo())
+
+	default:
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("Unknown admin request %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (a *AdminServer) addBackend(w http.ResponseWriter, r *http.Request, routerName string) {
+	ber, err := a.lbl.GetBackendRouterByName(routerName)
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	var bec BackendConfig
+	err = json.NewDecoder(r.Body).Decode(&bec)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	u, err := url.Parse(bec.Host)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("Backend host %s is not a valid URL", bec.Host))
+		return
+	}
+
+	if bec.MaxConnections <= 0 || bec.Weight < 0 {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("maxconnections must be > 0 and weight cannot be negative"))
+		return
+	}
+
+	_, err = ber.GetBackendByHost(bec.Host)
+	if err == nil {
+		writeAdminError(w, http.StatusConflict, fmt.Errorf("Backend %s already exists in router %s", bec.Host, ber.Name))
+		return
+	}
+
+	be := NewBackend(bec.Host, bec.Port, bec.MaxConnections)
+	be.SendProxyProtocol = bec.SendProxyProtocol
+	be.SetWeight(bec.GetWeight())
+	be.SetAdaptiveConcurrency(ber.adaptiveConcurrency)
+	ber.AddBackend(be)
+	log.Infof("Admin API: added backend %s to router %s", bec.Host, ber.Name)
+	writeAdminJSON(w, http.StatusCreated, ber.getInfo())
+}
+
+func (a *AdminServer) updateBackend(w http.ResponseWriter, r *http.Request, routerName string, host string) {
+	ber, err := a.lbl.GetBackendRouterByName(routerName)
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	be, err := ber.GetBackendByHost(host)
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	var update backendUpdate
+	err = json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// validate everything before changing anything.
+	var state BackendState
+	if update.State != nil {
+		state, err = ParseBackendState(*update.State)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	if update.Weight != nil && *update.Weight < 0 {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("weight cannot be negative"))
+		return
+	}
+
+	if update.Weight != nil {
+		be.SetWeight(*update.Weight)
+	}
+
+	if update.State != nil {
+		be.SetState(state)
+	}
+
+	log.Infof("Admin API: backend %s in router %s now weight %d state %s", be.Host, ber.Name, be.GetWeight(), be.GetState())
+	writeAdminJSON(w, http.StatusOK, be.getInfo())
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Errorf("Admin API: unable to write response: %s", err.Error())
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func doAdminRequest(admin *AdminServer, method string, path string, body string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	res := httptest.NewRecorder()
+	admin.ServeHTTP(res, req)
+	return res
+}
+
+func generateTestAdminServer(t *testing.T) *AdminServer {
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(generateTestConfig("/foo"))
+	assert.Nil(t, err, "Error not expected")
+	return NewAdminServer(lbl, 9000, "secret")
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	admin := generateTestAdminServer(t)
+	res := doAdminRequest(admin, http.MethodGet, "/routers", "", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+}
+
+func TestAdminListRouters(t *testing.T) {
+	admin := generateTestAdminServer(t)
+	res := doAdminRequest(admin, http.MethodGet, "/routers", "", "secret")
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	var routers []RouterInfo
+	err := json.NewDecoder(res.Body).Decode(&routers)
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, "/foo", routers[0].Name)
+	assert.Equal(t, "active", routers[0].Backends[0].State)
+}
+
+func TestAdminAddUpdateRemoveBackend(t *testing.T) {
+	admin := generateTestAdminServer(t)
+	res := doAdminRequest(admin, http.MethodPost, "/routers/%2Ffoo/backends", `{"host": "http://10.0.0.2:5000", "maxconnections": 5, "weight": 3}`, "secret")
+	assert.Equal(t, http.StatusCreated, res.Code)
+
+	ber, _ := admin.lbl.GetBackendRouterByName("/foo")
+	be, err := ber.GetBackendByHost("http://10.0.0.2:5000")
+	assert.Nil(t, err, "Backend should have been added")
+	assert.Equal(t, 3, be.GetWeight())
+
+	res = doAdminRequest(admin, http.MethodPatch, "/routers/%2Ffoo/backends/http:%2F%2F10.0.0.2:5000", `{"state": "draining", "weight": 7}`, "secret")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, BackendDraining, be.GetState())
+	assert.Equal(t, 7, be.GetWeight())
+
+	res = doAdminRequest(admin, http.MethodPatch, "/routers/%2Ffoo/backends/http:%2F%2F10.0.0.2:5000", `{"state": "sleepy"}`, "secret")
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	res = doAdminRequest(admin, http.MethodDelete, "/routers/%2Ffoo/backends/http:%2F%2F10.0.0.2:5000", "", "secret")
+	assert.Equal(t, http.StatusOK, res.Code)
+	_, err = ber.GetBackendByHost("http://10.0.0.2:5000")
+	assert.NotNil(t, err, "Backend should have been removed")
+}
+
+func TestGetBackendSkipsDrainingBackends(t *testing.T) {
+	ber := NewBackendRouter(nil, make(map[string]bool), BackendRoundRobin)
+	be1 := NewBackend("http://10.0.0.1:5000", 5000, 1)
+	be2 := NewBackend("http://10.0.0.2:5000", 5000, 1)
+	ber.AddBackend(be1)
+	ber.AddBackend(be2)
+	be1.SetState(BackendDraining)
+
+	for i := 0; i < 5; i++ {
+		be, err := ber.GetBackend()
+		assert.Nil(t, err, "Error not expected")
+		assert.Same(t, be2, be)
+	}
+}
@@ -7,17 +7,63 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	RetryID int = 1
 
+	// context key for the requestInfo of a request.
+	RequestInfoID int = 2
+
 	RetryAttempts  int           = 10
 	RetryDelayInMS time.Duration = 50
+
+	// DefaultBackendWeight is used when a backend is configured without a weight.
+	DefaultBackendWeight int = 1
 )
 
+type BackendState int
+
+const (
+	// BackendActive backends are used for new requests (if alive).
+	BackendActive BackendState = 0
+
+	// BackendDraining backends get no new requests but in-flight requests are left to complete.
+	BackendDraining BackendState = 1
+
+	// BackendDisabled backends get no requests and are not health checked.
+	BackendDisabled BackendState = 2
+)
+
+var BackendStateMap = map[string]BackendState{
+	"active":   BackendActive,
+	"draining": BackendDraining,
+	"disabled": BackendDisabled,
+}
+
+// String returns the name of the state as used in the admin API.
+func (s BackendState) String() string {
+	for name, state := range BackendStateMap {
+		if state == s {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// ParseBackendState converts the name of a state (active, draining, disabled) to BackendState.
+func ParseBackendState(state string) (BackendState, error) {
+	s, ok := BackendStateMap[strings.ToLower(state)]
+	if !ok {
+		return BackendActive, fmt.Errorf("Unknown backend state %s", state)
+	}
+	return s, nil
+}
+
 // Backend is unique for a given host:port. This might be pointing to a single machine or possibly a LB/cluster.
 // The Backend has a collection of BackendConnections. These BackendConnections are the REAL connections to the given
 // target machine
@@ -31,6 +77,22 @@ type Backend struct {
 	// Is this backend alive/dead
 	Alive    bool
 	aliveMux sync.RWMutex
+
+	// Relative share of traffic compared to other backends in the same router.
+	Weight int
+
+	// send a PROXY protocol header on each connection. Set before the backend is used.
+	SendProxyProtocol bool
+
+	// active/draining/disabled. Set through admin API.
+	State    BackendState
+	stateMux sync.RWMutex
+
+	// number of requests currently being proxied to this backend.
+	inFlight int64
+
+	// adjusts how many requests the backend is given at once, nil if not enabled. Protected by mux.
+	concurrency *concurrencyLimiter
 }
 
 func NewBackend(host string, port int, maxConnections int) *Backend {
@@ -39,20 +101,27 @@ func NewBackend(host string, port int, maxConnections int) *Backend {
 	be.Port = port
 	be.Alive = true
 	be.MaxConnections = maxConnections
+	be.Weight = DefaultBackendWeight
+	be.State = BackendActive
 	return &be
 }
 
-// LogStats... just a hack to get some data. Log stats (used connections etc).
-func (ber *Backend) LogStats() error {
+// SetMaxConnections changes the size the BackendConnection pool can grow to. If shrinking, existing
+// connections are left alone but no new ones will be made until the pool is under the new limit.
+func (ber *Backend) SetMaxConnections(maxConnections int) {
+	ber.mux.Lock()
+	ber.MaxConnections = maxConnections
+	ber.mux.Unlock()
+}
 
-	becInUse := 0
+// CloseIdleConnections closes the idle keep-alive connections of every BackendConnection in the pool.
+// Requests in flight are left alone.
+func (ber *Backend) CloseIdleConnections() {
+	ber.mux.RLock()
+	defer ber.mux.RUnlock()
 	for _, bec := range ber.BackendConnections {
-		if bec.IsInUse() {
-			becInUse++
-		}
+		bec.CloseIdleConnections()
 	}
-	log.Infof("Backend %s : currently in use %d", ber.Host, becInUse)
-	return nil
 }
 
 // GetAttemptsFromContext returns the attempts for request
@@ -82,12 +151,36 @@ func (ber *Backend) GetBackendConnection() (*BackendConnection, error) {
 	if len(ber.BackendConnections) < ber.MaxConnections {
 		//log.Infof("backend url %s", ber.Host)
 		bec := NewBackendConnection(ber.Host)
+		if ber.SendProxyProtocol {
+			bec.EnableProxyProtocol()
+		}
 		bec.SetInUse(true)
 		bec.ReverseProxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
 
 			retries := GetRetryFromContext(request)
+			info := getRequestInfo(request)
+
+			// rest of the body wasn't sent, so the backend can't have handled it and retrying would fail the same way.
+			if info != nil && info.body != nil && info.body.isExceeded() {
+				requestLog(request).Warnf("Request body over the limit of %d for router %s", info.router.MaxRequestBodyBytes, info.routerName())
+				writeError(writer, request, http.StatusRequestEntityTooLarge, "Request body too large")
+				info.metrics.observeRejection(info.routerName(), http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			// client has gone (or the connection was closed on shutdown), so no point retrying and
+			// not the backend's fault.
+			if request.Context().Err() != nil {
+				requestLog(request).Warnf("Request cancelled, not retrying: %s", e.Error())
+				return
+			}
+
 			if retries < RetryAttempts {
-				log.Errorf("Failed query, delaying and retrying: %d : %s", retries, e.Error()) // TODO(kpfaulkner) add retry logic here.
+				requestLog(request).Errorf("Failed query, delaying and retrying: %d : %s", retries, e.Error()) // TODO(kpfaulkner) add retry logic here.
+				if info != nil {
+					info.retries++
+					info.metrics.observeRetry(info.routerName(), ber.Host)
+				}
 				<-time.After(RetryDelayInMS * time.Millisecond)
 				ctx := context.WithValue(request.Context(), RetryID, retries+1)
 				bec.ReverseProxy.ServeHTTP(writer, request.WithContext(ctx))
@@ -95,8 +188,11 @@ func (ber *Backend) GetBackendConnection() (*BackendConnection, error) {
 			}
 
 			ber.SetIsAlive(false)
-			log.Errorf("Backend <find ID> returned error. Pausing... %s", e.Error()) // TODO(kpfaulkner) add retry logic here.
-			writer.WriteHeader(http.StatusTooManyRequests)
+			requestLog(request).Errorf("Backend %s returned error. Pausing... %s", ber.Host, e.Error()) // TODO(kpfaulkner) add retry logic here.
+			writeError(writer, request, http.StatusTooManyRequests, "Too many requests")
+			if info != nil {
+				info.metrics.observeRejection(info.routerName(), http.StatusTooManyRequests)
+			}
 		}
 
 		ber.BackendConnections = append(ber.BackendConnections, bec)
@@ -124,6 +220,48 @@ func (b *Backend) checkHealth() error {
 	return nil
 }
 
+// isSelectable returns true if the backend can be given new requests.
+func (b *Backend) isSelectable() bool {
+	return b.IsAlive() && b.GetState() == BackendActive && b.GetWeight() > 0
+}
+
+func (b *Backend) GetWeight() int {
+	b.stateMux.RLock()
+	defer b.stateMux.RUnlock()
+	return b.Weight
+}
+
+func (b *Backend) SetWeight(weight int) {
+	b.stateMux.Lock()
+	b.Weight = weight
+	b.stateMux.Unlock()
+}
+
+func (b *Backend) GetState() BackendState {
+	b.stateMux.RLock()
+	defer b.stateMux.RUnlock()
+	return b.State
+}
+
+func (b *Backend) SetState(state BackendState) {
+	b.stateMux.Lock()
+	b.State = state
+	b.stateMux.Unlock()
+}
+
+// InFlight returns the number of requests currently being proxied to this backend.
+func (b *Backend) InFlight() int64 {
+	return atomic.LoadInt64(&b.inFlight)
+}
+
+func (b *Backend) incInFlight() {
+	atomic.AddInt64(&b.inFlight, 1)
+}
+
+func (b *Backend) decInFlight() {
+	atomic.AddInt64(&b.inFlight, -1)
+}
+
 func (b *Backend) IsAlive() bool {
 	var alive bool
 	b.aliveMux.RLock()
@@ -18,6 +18,7 @@ type BackendConnection struct {
 	inUseMux sync.RWMutex
 
 	ReverseProxy *httputil.ReverseProxy
+	transport    *http.Transport
 }
 
 func NewBackendConnection(uri string) *BackendConnection {
@@ -30,17 +31,82 @@ func NewBackendConnection(uri string) *BackendConnection {
 
 	be.InUse = false
 	be.ReverseProxy = httputil.NewSingleHostReverseProxy(be.url)
-	be.ReverseProxy.Transport = &http.Transport{DialTLS: dialTLS, IdleConnTimeout: 90 * time.Second, TLSHandshakeTimeout: 10 * time.Second}
+	be.transport = &http.Transport{DialTLS: dialTLS, IdleConnTimeout: 90 * time.Second, TLSHandshakeTimeout: 10 * time.Second}
+	be.ReverseProxy.Transport = &tracingTransport{base: be.transport}
 	director := be.ReverseProxy.Director
 	be.ReverseProxy.Director = func(req *http.Request) {
+		info := getRequestInfo(req)
+
+		// this runs again on retries, so start from the client's URL and headers each time rather than
+		// rewrite them twice.
+		if info != nil && info.inbound.url != nil {
+			u := *info.inbound.url
+			req.URL = &u
+			req.Header = info.inbound.header.Clone()
+		}
+
+		// before the director adds the backend's path.
+		if info != nil && info.router != nil && info.router.pathRewriter != nil {
+			info.router.pathRewriter.rewrite(req.URL)
+		}
+
 		director(req)
 		//req.URL.Scheme = "http"   // TODO(kpfaulkner) Need to determine if this is ok or if need to be determined from query?
-		req.Host = req.URL.Host
+		if info == nil || info.router == nil || !info.router.PreserveHost {
+			req.Host = req.URL.Host
+		}
+		if info != nil && info.forwarding != nil {
+			info.forwarding.setHeaders(req, info.inbound)
+		}
+
+		// after the forwarding headers, so rules can override them.
+		if info != nil && info.router != nil && info.router.headerRules != nil {
+			info.router.headerRules.modifyRequest(req, info)
+		}
+	}
+
+	be.ReverseProxy.ModifyResponse = func(resp *http.Response) error {
+		info := getRequestInfo(resp.Request)
+		if info != nil {
+			info.upstreamLatency = time.Since(info.upstreamStart)
+		}
+
+		// already set on the response by LBLight, don't want it twice if the backend echoes it.
+		resp.Header.Del(RequestIDHeader)
+
+		if info != nil && info.router != nil && info.router.pathRewriter != nil && isRedirect(resp) {
+			if location := resp.Header.Get("Location"); location != "" {
+				resp.Header.Set("Location", info.router.pathRewriter.rewriteLocation(location, be.url))
+			}
+		}
+
+		if resp.StatusCode >= 500 && info.interceptBackendErrors() {
+			replaceBackendError(resp, info)
+		}
+
+		if info != nil && info.router != nil && info.router.headerRules != nil {
+			info.router.headerRules.modifyResponse(resp, info)
+		}
+		return nil
 	}
 
 	return &be
 }
 
+// EnableProxyProtocol sends a PROXY protocol v2 header, with the client's address, on every connection
+// to the backend. The header describes a single client, so connections are not kept alive for reuse.
+func (b *BackendConnection) EnableProxyProtocol() {
+	b.transport.DialTLS = nil
+	b.transport.DialContext = dialWithProxyHeader
+	b.transport.DialTLSContext = dialTLSWithProxyHeader
+	b.transport.DisableKeepAlives = true
+}
+
+// CloseIdleConnections closes any keep-alive connections to the backend that aren't being used.
+func (b *BackendConnection) CloseIdleConnections() {
+	b.transport.CloseIdleConnections()
+}
+
 func (b *BackendConnection) IsInUse() bool {
 	var inUse bool
 	b.inUseMux.RLock()
@@ -21,6 +21,16 @@ var BackendSelectionMap = map[string]BackendSelectionMethod{
 	"random":          BackendRandom,
 }
 
+// String returns the config name of the selection method.
+func (b BackendSelectionMethod) String() string {
+	for name, method := range BackendSelectionMap {
+		if method == b {
+			return name
+		}
+	}
+	return "unknown"
+}
+
 func ParseBackendSelectionString(bes string) BackendSelectionMethod {
 
 	var ok bool
@@ -38,9 +48,40 @@ func ParseBackendSelectionString(bes string) BackendSelectionMethod {
 // The BackendRouter determines which Backend should receive the request, this could be based on
 // random/round-robin/load-tracking/wild-guess etc.
 type BackendRouter struct {
+	// Name identifies the router in logs and across config reloads.
+	Name string
+
+	// send the client's Host header to the backend instead of the backend's host.
+	PreserveHost bool
+
+	// largest request body accepted, 0 for no limit.
+	MaxRequestBodyBytes int64
+
+	// routers with a matcher are checked highest Priority first, before the path/host lookup.
+	Priority int
+
+	// extra conditions (method, query, regex etc) a request has to meet, nil if only routed by path/host.
+	matcher *routeMatcher
+
+	// used when none of the backends are available, nil if there's no fallback.
+	fallback *BackendRouter
+
+	// error pages for the router, nil to use the global ones.
+	errorPages *errorPages
+
+	// changes the path sent to the backend, nil if it's sent as is.
+	pathRewriter *pathRewriter
+
+	// changes made to request/response headers, nil if none.
+	headerRules *headerRules
+
 	// if the beginning of the request is in acceptedPaths, then use this backend.
 	acceptedPaths map[string]bool
 
+	// only use this backend for requests to these hosts (lower case, may be wildcards like *.example.com).
+	// Empty means any host.
+	acceptedHosts map[string]bool
+
 	// if the header (key) in acceptedHeaders matches the value, then use this backend
 	acceptedHeaders map[string]string
 
@@ -50,8 +91,14 @@ type BackendRouter struct {
 	// roundrobin etc.
 	backendSelectionMethod BackendSelectionMethod
 
-	// last backend selected (for round robin)
-	lastBackendSelected int
+	// per client rate limiting, nil if not limited.
+	rateLimiter *rateLimiter
+
+	// applied to each backend, including ones added through the admin API.
+	adaptiveConcurrency AdaptiveConcurrencyConfig
+
+	// running weights for smooth weighted round robin (same approach as nginx).
+	currentWeights map[*Backend]int
 
 	mux sync.RWMutex
 }
@@ -61,6 +108,7 @@ func NewBackendRouter(acceptedHeaders map[string]string, acceptedPaths map[strin
 	ber.acceptedHeaders = acceptedHeaders
 	ber.acceptedPaths = acceptedPaths
 	ber.backendSelectionMethod = bes
+	ber.currentWeights = make(map[*Backend]int)
 	return &ber
 }
 
@@ -73,9 +121,61 @@ func (ber *BackendRouter) AddBackend(backend *Backend) error {
 	return nil
 }
 
-func (ber *BackendRouter) checkHealthOfAllBackends() error {
+// RemoveBackend removes the backend with the given host from the router. Requests already using the
+// backend are left to complete.
+func (ber *BackendRouter) RemoveBackend(host string) error {
+
+	ber.mux.Lock()
+	defer ber.mux.Unlock()
+	for index, be := range ber.backends {
+		if be.Host == host {
+			ber.backends = append(ber.backends[:index:index], ber.backends[index+1:]...)
+			delete(ber.currentWeights, be)
+			return nil
+		}
+	}
+	return fmt.Errorf("Unable to find backend %s in router %s", host, ber.Name)
+}
+
+// GetBackendByHost returns the backend with the given host.
+func (ber *BackendRouter) GetBackendByHost(host string) (*Backend, error) {
 
+	ber.mux.RLock()
+	defer ber.mux.RUnlock()
 	for _, be := range ber.backends {
+		if be.Host == host {
+			return be, nil
+		}
+	}
+	return nil, fmt.Errorf("Unable to find backend %s in router %s", host, ber.Name)
+}
+
+// getAcceptedPaths returns the paths the router accepts. A router limited to hosts with no paths
+// accepts every path on those hosts.
+func (ber *BackendRouter) getAcceptedPaths() map[string]bool {
+	if len(ber.acceptedPaths) == 0 && len(ber.acceptedHosts) > 0 {
+		return map[string]bool{"": true}
+	}
+	return ber.acceptedPaths
+}
+
+// getBackends returns a copy of the backends list, safe to iterate while backends are being added.
+func (ber *BackendRouter) getBackends() []*Backend {
+	ber.mux.RLock()
+	defer ber.mux.RUnlock()
+	backends := make([]*Backend, len(ber.backends))
+	copy(backends, ber.backends)
+	return backends
+}
+
+func (ber *BackendRouter) checkHealthOfAllBackends() error {
+
+	for _, be := range ber.getBackends() {
+
+		// disabled backends are left alone until re-enabled.
+		if be.GetState() == BackendDisabled {
+			continue
+		}
 
 		// ignoring error return value.
 		// The error will be indicating if the backend is healthy or not, and the Backend itself
@@ -94,42 +194,51 @@ func (ber *BackendRouter) GetBackend() (*Backend, error) {
 	ber.mux.Lock()
 	defer ber.mux.Unlock()
 
+	// all backends may have been configured out (maxconnections 0).
+	if len(ber.backends) == 0 {
+		return nil, fmt.Errorf("No backends configured for router %s", ber.Name)
+	}
+
+	// only backends that are alive, active and have a weight can be selected.
+	var candidates []*Backend
+	totalWeight := 0
+	for _, be := range ber.backends {
+		if be.isSelectable() {
+			candidates = append(candidates, be)
+			totalWeight += be.GetWeight()
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("No backends available for router %s", ber.Name)
+	}
+
 	switch ber.backendSelectionMethod {
 	case BackendRandom:
 
-		count := 5
-
-		// get next alive backend.
-		for count > 0 {
-			r := rand.Intn(len(ber.backends))
-			be := ber.backends[r]
-			if be.IsAlive() {
+		// weighted random, each backend gets weight/totalWeight share of requests.
+		r := rand.Intn(totalWeight)
+		for _, be := range candidates {
+			r -= be.GetWeight()
+			if r < 0 {
 				return be, nil
 			}
-			count--
 		}
-
-		// unable to get backend.... throw error.
-		return nil, fmt.Errorf("Unable to get backend <TODO figure out identificiation here>")
+		return candidates[len(candidates)-1], nil
 
 	case BackendRoundRobin:
-		count := 5
-		for count > 0 {
-			// need to put this in a lock. TODO(kpfaulkner)
-			ber.lastBackendSelected++
-			if ber.lastBackendSelected >= len(ber.backends) {
-				ber.lastBackendSelected = 0
-			}
 
-			be := ber.backends[ber.lastBackendSelected]
-			if be.IsAlive() {
-				return be, nil
+		// smooth weighted round robin. Each candidate accumulates its weight, the highest is picked and
+		// has the total subtracted. With equal weights this is plain round robin.
+		var selected *Backend
+		for _, be := range candidates {
+			ber.currentWeights[be] += be.GetWeight()
+			if selected == nil || ber.currentWeights[be] > ber.currentWeights[selected] {
+				selected = be
 			}
-			count--
 		}
-
-		// unable to get backend.... throw error.
-		return nil, fmt.Errorf("Unable to get backend <TODO figure out identificiation here>")
+		ber.currentWeights[selected] -= totalWeight
+		return selected, nil
 
 	case BackendInuseConnections:
 		// need to calculate based off number of connections etc.....    TODO(kpfaulkner)
@@ -15,13 +15,13 @@ func TestAddBackendSuccess(t *testing.T) {
 func TestGetBackendFail(t *testing.T) {
 	ber := NewBackendRouter(nil, make(map[string]bool), BackendRandom)
 	_, err := ber.GetBackend()
-	assert.NotNil(t, nil, err, "No backends expected")
+	assert.NotNil(t, err, "No backends expected")
 }
 
 func TestGetBackendRandomFail(t *testing.T) {
 	ber := NewBackendRouter(nil, make(map[string]bool), BackendRoundRobin)
 	_, err := ber.GetBackend()
-	assert.NotNil(t, nil, err, "No backends expected")
+	assert.NotNil(t, err, "No backends expected")
 }
 
 
@@ -10,7 +10,11 @@ func dialTLS(network, addr string) (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
+	return clientTLS(conn, addr)
+}
 
+// clientTLS does the TLS handshake on an established connection to addr.
+func clientTLS(conn net.Conn, addr string) (net.Conn, error) {
 	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
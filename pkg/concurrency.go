@@ -0,0 +1,235 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ConcurrencyGradient string = "gradient"
+	ConcurrencyAIMD     string = "aimd"
+
+	DefaultConcurrencyInitialLimit = 20
+	DefaultConcurrencyMinLimit     = 1
+	DefaultConcurrencyMaxLimit     = 1000
+	DefaultConcurrencyLatency      = time.Second
+
+	// gradient: how far above the long term latency the short term latency can be before the limit drops,
+	// and how much each sample moves the limit.
+	gradientTolerance = 2.0
+	gradientSmoothing = 0.2
+
+	// gradient: number of samples the long term latency is averaged over.
+	gradientLongWindow = 600
+
+	// aimd: how much the limit is cut by when the backend is overloaded.
+	aimdBackoffRatio = 0.9
+)
+
+// AdaptiveConcurrencyConfig configures a limit on concurrent requests to each backend of a router that
+// adjusts itself from the latency the backend is showing. Requests over the limit get a 503 instead of
+// queueing up at a backend that is already struggling.
+type AdaptiveConcurrencyConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+
+	// "gradient" (default) compares recent latency to the long term latency, and lowers the limit as
+	// latency rises. "aimd" adds 1 to the limit while requests are fine, and cuts it by 10% when a request
+	// fails or takes longer than LatencyThresholdInMilliseconds.
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// limit to start with, and the range it can move in. Defaults 20, 1 and 1000.
+	InitialLimit int `json:"initiallimit,omitempty"`
+	MinLimit     int `json:"minlimit,omitempty"`
+	MaxLimit     int `json:"maxlimit,omitempty"`
+
+	// aimd: requests slower than this count as the backend being overloaded. Defaults to 1000.
+	LatencyThresholdInMilliseconds int `json:"latencythresholdinmilliseconds,omitempty"`
+}
+
+// Validate checks the adaptive concurrency config.
+func (c AdaptiveConcurrencyConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	algorithm := strings.ToLower(c.Algorithm)
+	if algorithm != "" && algorithm != ConcurrencyGradient && algorithm != ConcurrencyAIMD {
+		return fmt.Errorf("Unknown AdaptiveConcurrency algorithm %s", c.Algorithm)
+	}
+	if c.InitialLimit < 0 || c.MinLimit < 0 || c.MaxLimit < 0 || c.LatencyThresholdInMilliseconds < 0 {
+		return fmt.Errorf("AdaptiveConcurrency limits and latencythresholdinmilliseconds cannot be negative")
+	}
+	if c.GetMinLimit() > c.GetMaxLimit() {
+		return fmt.Errorf("AdaptiveConcurrency minlimit cannot be more than maxlimit")
+	}
+	return nil
+}
+
+// GetInitialLimit returns the configured initial limit (kept within min/max), or the default if not set.
+func (c AdaptiveConcurrencyConfig) GetInitialLimit() int {
+	limit := c.InitialLimit
+	if limit == 0 {
+		limit = DefaultConcurrencyInitialLimit
+	}
+	return int(math.Max(float64(c.GetMinLimit()), math.Min(float64(c.GetMaxLimit()), float64(limit))))
+}
+
+// GetMinLimit returns the configured minimum limit, or the default if not set.
+func (c AdaptiveConcurrencyConfig) GetMinLimit() int {
+	if c.MinLimit == 0 {
+		return DefaultConcurrencyMinLimit
+	}
+	return c.MinLimit
+}
+
+// GetMaxLimit returns the configured maximum limit, or the default if not set.
+func (c AdaptiveConcurrencyConfig) GetMaxLimit() int {
+	if c.MaxLimit == 0 {
+		return DefaultConcurrencyMaxLimit
+	}
+	return c.MaxLimit
+}
+
+// GetLatencyThreshold returns the configured latency threshold, or the default if not set.
+func (c AdaptiveConcurrencyConfig) GetLatencyThreshold() time.Duration {
+	if c.LatencyThresholdInMilliseconds == 0 {
+		return DefaultConcurrencyLatency
+	}
+	return time.Duration(c.LatencyThresholdInMilliseconds) * time.Millisecond
+}
+
+// concurrencyLimiter limits the requests in flight to a backend, adjusting the limit from the results
+// of requests as they complete.
+type concurrencyLimiter struct {
+	config   AdaptiveConcurrencyConfig
+	aimd     bool
+	limit    float64
+	inFlight int
+
+	// gradient: exponential moving average of latency, in seconds.
+	longRTT float64
+
+	mux sync.Mutex
+}
+
+func newConcurrencyLimiter(config AdaptiveConcurrencyConfig) *concurrencyLimiter {
+	cl := concurrencyLimiter{config: config, limit: float64(config.GetInitialLimit())}
+	cl.aimd = strings.ToLower(config.Algorithm) == ConcurrencyAIMD
+	return &cl
+}
+
+// acquire reserves a slot for a request. Returns false if the backend is at its limit, otherwise release
+// must be called once the request completes.
+func (cl *concurrencyLimiter) acquire() bool {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+
+	if cl.inFlight >= int(cl.limit) {
+		return false
+	}
+	cl.inFlight++
+	return true
+}
+
+// release frees the slot and adjusts the limit. rtt is how long the request took, dropped is true if
+// the backend failed or was overloaded.
+func (cl *concurrencyLimiter) release(rtt time.Duration, dropped bool) {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+
+	inFlight := cl.inFlight
+	cl.inFlight--
+
+	if cl.aimd {
+		cl.updateAIMD(rtt, dropped, inFlight)
+	} else {
+		cl.updateGradient(rtt, dropped, inFlight)
+	}
+	cl.limit = math.Max(float64(cl.config.GetMinLimit()), math.Min(float64(cl.config.GetMaxLimit()), cl.limit))
+}
+
+func (cl *concurrencyLimiter) updateAIMD(rtt time.Duration, dropped bool, inFlight int) {
+	if dropped || rtt > cl.config.GetLatencyThreshold() {
+		cl.limit = cl.limit * aimdBackoffRatio
+		return
+	}
+
+	// only grow if the limit is actually being used, otherwise a quiet period would grow it without bound.
+	if inFlight*2 >= int(cl.limit) {
+		cl.limit++
+	}
+}
+
+// updateGradient works the same way as Netflix's Gradient2 limit. While recent latency is within
+// gradientTolerance of the long term latency the limit grows by sqrt(limit), beyond that it shrinks in
+// proportion to how much latency has grown.
+func (cl *concurrencyLimiter) updateGradient(rtt time.Duration, dropped bool, inFlight int) {
+	shortRTT := rtt.Seconds()
+	if shortRTT <= 0 {
+		return
+	}
+
+	if cl.longRTT == 0 {
+		cl.longRTT = shortRTT
+	} else {
+		cl.longRTT += (shortRTT - cl.longRTT) / gradientLongWindow
+	}
+
+	// latency has dropped a lot (eg. after recovering), so catch up faster.
+	if cl.longRTT/shortRTT > 2 {
+		cl.longRTT *= 0.95
+	}
+
+	if dropped {
+		cl.limit = cl.limit * aimdBackoffRatio
+		return
+	}
+
+	// not using the limit, so the latency says nothing about whether it's right.
+	if float64(inFlight) < cl.limit/2 {
+		return
+	}
+
+	gradient := math.Max(0.5, math.Min(1.0, gradientTolerance*cl.longRTT/shortRTT))
+	newLimit := cl.limit*gradient + math.Sqrt(cl.limit)
+	cl.limit = cl.limit*(1-gradientSmoothing) + newLimit*gradientSmoothing
+}
+
+// getLimit returns the current limit.
+func (cl *concurrencyLimiter) getLimit() int {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+	return int(cl.limit)
+}
+
+// isOverloaded returns true if the response means the backend couldn't cope.
+func isOverloaded(status int, retries int) bool {
+	return retries > 0 || status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// SetAdaptiveConcurrency enables (or disables) adaptive concurrency for the backend. The current limit
+// is kept if the config hasn't changed.
+func (b *Backend) SetAdaptiveConcurrency(config AdaptiveConcurrencyConfig) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if !config.Enabled {
+		b.concurrency = nil
+		return
+	}
+	if b.concurrency != nil && b.concurrency.config == config {
+		return
+	}
+	b.concurrency = newConcurrencyLimiter(config)
+}
+
+// getConcurrencyLimiter returns the backend's adaptive concurrency limiter, nil if not enabled.
+func (b *Backend) getConcurrencyLimiter() *concurrencyLimiter {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.concurrency
+}
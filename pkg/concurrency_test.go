@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// runAtLimit fills the limiter and completes all the requests with rtt, n times.
+func runAtLimit(cl *concurrencyLimiter, n int, rtt time.Duration, dropped bool) {
+	for i := 0; i < n; i++ {
+		acquired := 0
+		for cl.acquire() {
+			acquired++
+		}
+		for j := 0; j < acquired; j++ {
+			cl.release(rtt, dropped)
+		}
+	}
+}
+
+func TestConcurrencyLimiterAIMD(t *testing.T) {
+	cl := newConcurrencyLimiter(AdaptiveConcurrencyConfig{Enabled: true, Algorithm: "AIMD", InitialLimit: 10, MaxLimit: 15, LatencyThresholdInMilliseconds: 100})
+
+	for i := 0; i < 10; i++ {
+		assert.True(t, cl.acquire(), "Expected slot")
+	}
+	assert.False(t, cl.acquire(), "Expected limit reached")
+
+	// grows while requests are fine, up to max.
+	cl.release(10*time.Millisecond, false)
+	assert.Equal(t, 11, cl.getLimit())
+	runAtLimit(cl, 10, 10*time.Millisecond, false)
+	assert.Equal(t, 15, cl.getLimit())
+
+	// cut back when slow or failing.
+	cl = newConcurrencyLimiter(AdaptiveConcurrencyConfig{Enabled: true, Algorithm: "aimd", InitialLimit: 10, LatencyThresholdInMilliseconds: 100})
+	cl.acquire()
+	cl.release(200*time.Millisecond, false)
+	assert.Equal(t, 9, cl.getLimit())
+	cl.acquire()
+	cl.release(10*time.Millisecond, true)
+	assert.Equal(t, 8, cl.getLimit())
+
+	// not below min.
+	runAtLimit(cl, 50, 0, true)
+	assert.Equal(t, 1, cl.getLimit())
+}
+
+func TestConcurrencyLimiterGradient(t *testing.T) {
+	cl := newConcurrencyLimiter(AdaptiveConcurrencyConfig{Enabled: true, InitialLimit: 10})
+
+	// steady latency, limit grows.
+	runAtLimit(cl, 5, 10*time.Millisecond, false)
+	grown := cl.getLimit()
+	assert.True(t, grown > 10, "Expected limit to grow, got %d", grown)
+
+	// latency well above the long term average, limit shrinks.
+	runAtLimit(cl, 10, 100*time.Millisecond, false)
+	assert.True(t, cl.getLimit() < grown, "Expected limit to shrink, got %d", cl.getLimit())
+
+	// not used, so not changed.
+	limit := cl.getLimit()
+	cl.acquire()
+	cl.release(time.Second, false)
+	assert.Equal(t, limit, cl.getLimit())
+}
+
+func TestAdaptiveConcurrencySheds(t *testing.T) {
+	backend, started, release := startBlockingBackend()
+	defer backend.Close()
+
+	config := generateTestConfig("/foo")
+	config.BackendRouterConfigs[0].BackendConfigs[0].Host = backend.URL
+	config.BackendRouterConfigs[0].AdaptiveConcurrency = AdaptiveConcurrencyConfig{Enabled: true, InitialLimit: 1, MaxLimit: 1}
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+
+	done := make(chan int)
+	go func() {
+		res := httptest.NewRecorder()
+		lbl.handleRequestsAndRedirect(res, httptest.NewRequest(http.MethodGet, "/foo", nil))
+		done <- res.Code
+	}()
+	<-started
+
+	res := httptest.NewRecorder()
+	lbl.handleRequestsAndRedirect(res, httptest.NewRequest(http.MethodGet, "/foo", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, 1, lbl.GetRouterInfo()[0].Backends[0].ConcurrencyLimit)
+
+	// slot is free again.
+	res = httptest.NewRecorder()
+	lbl.handleRequestsAndRedirect(res, httptest.NewRequest(http.MethodGet, "/foo", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+}
+
+// startTruncatingBackend returns a backend that stops half way through the response body.
+func startTruncatingBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+}
+
+// getAborted sends a request for path through a real server, as ReverseProxy only aborts the handler
+// (panics with http.ErrAbortHandler) when running under one. Returns the error the client saw.
+func getAborted(lbl *LBLight, path string) error {
+	front := httptest.NewServer(http.HandlerFunc(lbl.handleRequestsAndRedirect))
+	defer front.Close()
+
+	// fails on the response or the body, depending on how much got through before the abort.
+	resp, err := http.Get(front.URL + path)
+	if err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	return err
+}
+
+func TestAdaptiveConcurrencyReleasedOnAbortedResponse(t *testing.T) {
+	backend := startTruncatingBackend()
+	defer backend.Close()
+
+	config := generateTestConfig("/foo")
+	config.BackendRouterConfigs[0].BackendConfigs[0].Host = backend.URL
+	config.BackendRouterConfigs[0].AdaptiveConcurrency = AdaptiveConcurrencyConfig{Enabled: true, InitialLimit: 1, MaxLimit: 1}
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+
+	assert.NotNil(t, getAborted(lbl, "/foo"), "Expected truncated response")
+
+	router, _ := lbl.GetBackendRouterByName("/foo")
+	limiter := router.getBackends()[0].getConcurrencyLimiter()
+	assert.Eventually(t, func() bool {
+		limiter.mux.Lock()
+		defer limiter.mux.Unlock()
+		return limiter.inFlight == 0
+	}, 5*time.Second, 10*time.Millisecond, "Expected concurrency slot to be released")
+}
+
+func TestAdaptiveConcurrencyConfigValidation(t *testing.T) {
+	assert.Nil(t, AdaptiveConcurrencyConfig{}.Validate(), "Error not expected")
+	assert.Nil(t, AdaptiveConcurrencyConfig{Enabled: true, Algorithm: "aimd"}.Validate(), "Error not expected")
+	assert.NotNil(t, AdaptiveConcurrencyConfig{Enabled: true, Algorithm: "vegas"}.Validate(), "Expected unknown algorithm error")
+	assert.NotNil(t, AdaptiveConcurrencyConfig{Enabled: true, MinLimit: 10, MaxLimit: 5}.Validate(), "Expected min > max error")
+	assert.Equal(t, 5, AdaptiveConcurrencyConfig{MaxLimit: 5}.GetInitialLimit())
+}
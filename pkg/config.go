@@ -3,41 +3,450 @@ package pkg
 import (
 	"encoding/json"
 	"fmt"
-	"os"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultHealthCheckTimerInSeconds is used if the config doesn't specify a health check timer.
+	DefaultHealthCheckTimerInSeconds int = 5
+
+	// DefaultShutdownTimeoutInSeconds is used if the config doesn't specify how long to wait for in-flight requests on shutdown.
+	DefaultShutdownTimeoutInSeconds int = 30
 )
 
 type BackendConfig struct {
 	Host           string `json:"host"`
 	Port           int    `json:"port"`
 	MaxConnections int    `json:"maxconnections"`
+
+	// relative share of traffic, defaults to 1.
+	Weight int `json:"weight,omitempty"`
+
+	// send a PROXY protocol v2 header with the client address on each connection to the backend.
+	SendProxyProtocol bool `json:"sendproxyprotocol,omitempty"`
+}
+
+// GetWeight returns the configured weight, or the default if not set.
+func (c BackendConfig) GetWeight() int {
+	if c.Weight == 0 {
+		return DefaultBackendWeight
+	}
+	return c.Weight
 }
 
 type BackendRouterConfig struct {
+	Name            string            `json:"Name,omitempty"`
 	SelectionMethod string            `json:"SelectionMethod"`
 	AcceptedPaths   []string          `json:"AcceptedPaths,omitempty"`
 	AcceptedHeaders map[string]string `json:"AcceptedHeaders,omitempty"`
 	BackendConfigs  []BackendConfig   `json:"BackendConfigs,omitempty"`
+
+	// only route requests for these hosts (eg. api.example.com or *.example.com) to this router. Combined
+	// with AcceptedPaths if set, otherwise every path on the hosts. Empty means any host.
+	AcceptedHosts []string `json:"AcceptedHosts,omitempty"`
+
+	// send the client's Host header to the backends instead of the backend's host.
+	PreserveHost bool `json:"PreserveHost,omitempty"`
+
+	// limits requests per client (IP, API key or JWT claim). Disabled if not set.
+	RateLimit RateLimitConfig `json:"RateLimit,omitempty"`
+
+	// largest request body accepted, larger requests get a 413. 0 for no limit.
+	MaxRequestBodyBytes int64 `json:"MaxRequestBodyBytes,omitempty"`
+
+	// change the path sent to the backends: StripPrefix is removed, then AddPrefix added, then PathRewrites
+	// applied in order. Location headers in redirects are changed back (except for PathRewrites).
+	StripPrefix  string              `json:"StripPrefix,omitempty"`
+	AddPrefix    string              `json:"AddPrefix,omitempty"`
+	PathRewrites []PathRewriteConfig `json:"PathRewrites,omitempty"`
+
+	// add/set/remove/rename headers on requests to the backends and responses to the client.
+	Headers HeaderRulesConfig `json:"Headers,omitempty"`
+
+	// limits concurrent requests to each backend, adjusted from observed latency.
+	AdaptiveConcurrency AdaptiveConcurrencyConfig `json:"AdaptiveConcurrency,omitempty"`
+
+	// route on method, query parameters, path regex, headers or client IP as well. Routers with a Match are
+	// checked before the others, highest Priority first (config order for equal priorities), and can overlap.
+	Match    RouteMatchConfig `json:"Match,omitempty"`
+	Priority int              `json:"Priority,omitempty"`
+
+	// name of the router to send requests to when none of this router's backends are available.
+	FallbackRouter string `json:"FallbackRouter,omitempty"`
+
+	// error pages for this router, used before the global ErrorPages.
+	ErrorPages ErrorPagesConfig `json:"ErrorPages,omitempty"`
 }
 
 type Config struct {
-	HealthCheckTimerInSeconds int                   `json:"HealthCheckTimerInSeconds"`
-	CertCrtPath               string                `json:"certcrtpath"`
-	CertKeyPath               string                `json:"certkeypath"`
-	Host                      string                `json:"host"`
-	Port                      int                   `json:"port"`
-	TlsListener               bool                  `json:"tlslistener"`
-	BackendRouterConfigs      []BackendRouterConfig `json:"BackendRouterConfigs"`
+	HealthCheckTimerInSeconds int `json:"HealthCheckTimerInSeconds"`
+
+	// How often to check the config file for changes (and reload if changed). 0 disables watching, SIGHUP
+	// can still be used to force a reload.
+	ConfigWatchTimerInSeconds int `json:"ConfigWatchTimerInSeconds,omitempty"`
+
+	// On SIGTERM/SIGINT LBLight reports not ready, waits ShutdownDelayInSeconds (so the load balancer in front
+	// notices) then stops accepting connections and waits up to ShutdownTimeoutInSeconds for in-flight requests.
+	ShutdownDelayInSeconds   int `json:"ShutdownDelayInSeconds,omitempty"`
+	ShutdownTimeoutInSeconds int `json:"ShutdownTimeoutInSeconds,omitempty"`
+
+	// max size of request headers (431 if larger), 0 for the net/http default of 1MB. Needs a restart to change.
+	MaxHeaderBytes int `json:"MaxHeaderBytes,omitempty"`
+
+	// longest request URL accepted (414 if longer), 0 for no limit.
+	MaxURLLength int `json:"MaxURLLength,omitempty"`
+
+	// paths on the traffic port that LBLight answers itself with its liveness/readiness, instead of proxying.
+	// Empty means only available on the admin port (/healthz and /readyz).
+	LivenessPath  string `json:"LivenessPath,omitempty"`
+	ReadinessPath string `json:"ReadinessPath,omitempty"`
+
+	CertCrtPath string `json:"certcrtpath"`
+	CertKeyPath string `json:"certkeypath"`
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	TlsListener bool   `json:"tlslistener"`
+
+	// Port for the admin API. 0 disables it. AdminToken must be set if the admin API is enabled
+	// and is required as a bearer token on every admin request.
+	AdminPort  int    `json:"AdminPort,omitempty"`
+	AdminToken string `json:"AdminToken,omitempty"`
+
+	AccessLog AccessLogConfig `json:"AccessLog,omitempty"`
+
+	Tracing TracingConfig `json:"Tracing,omitempty"`
+
+	Forwarding ForwardingConfig `json:"Forwarding,omitempty"`
+
+	ProxyProtocol ProxyProtocolConfig `json:"ProxyProtocol,omitempty"`
+
+	// share rate limits between LBLight instances. Limits are per instance if not set.
+	RateLimitStore RateLimitStoreConfig `json:"RateLimitStore,omitempty"`
+
+	BackendRouterConfigs []BackendRouterConfig `json:"BackendRouterConfigs"`
+
+	// name of the router used for requests no other router matches. If not set they get the NotFound response.
+	DefaultRouter string         `json:"DefaultRouter,omitempty"`
+	NotFound      NotFoundConfig `json:"NotFound,omitempty"`
+
+	// pages sent for errors (by status code), instead of the plain error message.
+	ErrorPages ErrorPagesConfig `json:"ErrorPages,omitempty"`
+
+	// Include lists extra config files (files, glob patterns or directories) whose BackendRouterConfigs
+	// are merged into this config. Relative paths are relative to this config file.
+	Include []string `json:"Include,omitempty"`
+}
+
+// RouterName returns the configured name of the router. If no name is configured then one
+// is generated from the accepted paths and headers, so it's still stable across reloads.
+func (c BackendRouterConfig) RouterName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+
+	var headers []string
+	for header, val := range c.AcceptedHeaders {
+		headers = append(headers, fmt.Sprintf("%s=%s", header, val))
+	}
+	sort.Strings(headers)
+
+	// hosts first, so the same path on different hosts gets a different name.
+	var parts []string
+	parts = append(parts, c.AcceptedHosts...)
+	parts = append(parts, c.AcceptedPaths...)
+	parts = append(parts, headers...)
+	return strings.Join(parts, ",")
+}
+
+// validateHost checks an AcceptedHosts entry is a host name, or a wildcard "*.example.com".
+func validateHost(host string) error {
+	name := strings.TrimPrefix(host, "*.")
+	if name == "" || strings.ContainsAny(name, "*:/ ") || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") {
+		return fmt.Errorf("invalid host %s, must be a host name or *.domain", host)
+	}
+	return nil
+}
+
+// GetHealthCheckTimerInSeconds returns the configured health check timer, or the default if not set.
+func (c Config) GetHealthCheckTimerInSeconds() int {
+	if c.HealthCheckTimerInSeconds == 0 {
+		return DefaultHealthCheckTimerInSeconds
+	}
+	return c.HealthCheckTimerInSeconds
+}
+
+// Validate checks the config makes sense before it's used to build any routers. Returns the first
+// problem found.
+func (c Config) Validate() error {
+
+	if c.HealthCheckTimerInSeconds < 0 {
+		return fmt.Errorf("HealthCheckTimerInSeconds cannot be negative")
+	}
+
+	if c.ConfigWatchTimerInSeconds < 0 {
+		return fmt.Errorf("ConfigWatchTimerInSeconds cannot be negative")
+	}
+
+	if c.ShutdownDelayInSeconds < 0 || c.ShutdownTimeoutInSeconds < 0 {
+		return fmt.Errorf("ShutdownDelayInSeconds and ShutdownTimeoutInSeconds cannot be negative")
+	}
+
+	if c.MaxHeaderBytes < 0 || c.MaxURLLength < 0 {
+		return fmt.Errorf("MaxHeaderBytes and MaxURLLength cannot be negative")
+	}
+
+	for _, path := range []string{c.LivenessPath, c.ReadinessPath} {
+		if path != "" && !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("LivenessPath and ReadinessPath must start with /")
+		}
+	}
+	if c.LivenessPath != "" && c.LivenessPath == c.ReadinessPath {
+		return fmt.Errorf("LivenessPath and ReadinessPath cannot be the same")
+	}
+
+	if c.AdminPort > 0 && c.AdminToken == "" {
+		return fmt.Errorf("AdminToken must be set when AdminPort is configured")
+	}
+
+	err := c.AccessLog.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = c.Tracing.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = c.Forwarding.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = c.ProxyProtocol.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = c.RateLimitStore.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = c.ErrorPages.Validate()
+	if err != nil {
+		return err
+	}
+
+	if len(c.BackendRouterConfigs) == 0 {
+		return fmt.Errorf("No BackendRouterConfigs configured")
+	}
+
+	// the default and fallback routers don't need anything to route on, they're used by name.
+	referenced := map[string]bool{c.DefaultRouter: true}
+	for _, berConfig := range c.BackendRouterConfigs {
+		referenced[berConfig.FallbackRouter] = true
+	}
+
+	names := make(map[string]bool)
+	paths := make(map[string]bool)
+	headers := make(map[string]bool)
+	for index, berConfig := range c.BackendRouterConfigs {
+		name := berConfig.RouterName()
+		if name == "" {
+			if !berConfig.Match.Enabled() {
+				return fmt.Errorf("BackendRouterConfig %d has no AcceptedPaths, AcceptedHeaders, AcceptedHosts or Match", index)
+			}
+			return fmt.Errorf("BackendRouterConfig %d needs a Name", index)
+		}
+
+		matched := berConfig.Match.Enabled()
+		if len(berConfig.AcceptedPaths) == 0 && len(berConfig.AcceptedHeaders) == 0 && len(berConfig.AcceptedHosts) == 0 && !matched && !referenced[name] {
+			return fmt.Errorf("BackendRouterConfig %s has no AcceptedPaths, AcceptedHeaders, AcceptedHosts or Match", name)
+		}
+		if names[name] {
+			return fmt.Errorf("BackendRouterConfig %d : name %s used more than once", index, name)
+		}
+		names[name] = true
+
+		if berConfig.SelectionMethod != "" {
+			_, ok := BackendSelectionMap[strings.ToLower(berConfig.SelectionMethod)]
+			if !ok {
+				return fmt.Errorf("BackendRouterConfig %s : unknown SelectionMethod %s", name, berConfig.SelectionMethod)
+			}
+		}
+
+		err = berConfig.RateLimit.Validate()
+		if err != nil {
+			return fmt.Errorf("BackendRouterConfig %s : %s", name, err.Error())
+		}
+
+		if berConfig.MaxRequestBodyBytes < 0 {
+			return fmt.Errorf("BackendRouterConfig %s : MaxRequestBodyBytes cannot be negative", name)
+		}
+
+		_, err = newPathRewriter(berConfig.StripPrefix, berConfig.AddPrefix, berConfig.PathRewrites)
+		if err != nil {
+			return fmt.Errorf("BackendRouterConfig %s : %s", name, err.Error())
+		}
+
+		err = berConfig.Headers.Validate()
+		if err != nil {
+			return fmt.Errorf("BackendRouterConfig %s : %s", name, err.Error())
+		}
+
+		err = berConfig.AdaptiveConcurrency.Validate()
+		if err != nil {
+			return fmt.Errorf("BackendRouterConfig %s : %s", name, err.Error())
+		}
+
+		for _, host := range berConfig.AcceptedHosts {
+			err = validateHost(host)
+			if err != nil {
+				return fmt.Errorf("BackendRouterConfig %s : %s", name, err.Error())
+			}
+		}
+
+		err = berConfig.Match.Validate()
+		if err != nil {
+			return fmt.Errorf("BackendRouterConfig %s : %s", name, err.Error())
+		}
+
+		err = berConfig.ErrorPages.Validate()
+		if err != nil {
+			return fmt.Errorf("BackendRouterConfig %s : %s", name, err.Error())
+		}
+
+		// routers with a Match can overlap, their Priority decides.
+		if !matched {
+			// a path is only a conflict if it's registered for the same host (or both accept any host).
+			hosts := berConfig.AcceptedHosts
+			if len(hosts) == 0 {
+				hosts = []string{""}
+			}
+			routerPaths := berConfig.AcceptedPaths
+			if len(routerPaths) == 0 && len(berConfig.AcceptedHosts) > 0 {
+				routerPaths = []string{""}
+			}
+			for _, host := range hosts {
+				for _, path := range routerPaths {
+					key := strings.ToLower(host) + "|" + strings.ToLower(path)
+					if paths[key] {
+						if host == "" {
+							return fmt.Errorf("BackendRouterConfig %s : path %s already registered", name, path)
+						}
+						return fmt.Errorf("BackendRouterConfig %s : host %s path %s already registered", name, host, path)
+					}
+					paths[key] = true
+				}
+			}
+
+			for header, val := range berConfig.AcceptedHeaders {
+				key := header + ":" + val
+				if headers[key] {
+					return fmt.Errorf("BackendRouterConfig %s : header %s : %s already registered", name, header, val)
+				}
+				headers[key] = true
+			}
+		}
+
+		// reload, metrics and the admin API all identify a router's backends by host.
+		backendHosts := make(map[string]bool)
+		for _, beConfig := range berConfig.BackendConfigs {
+			if backendHosts[beConfig.Host] {
+				return fmt.Errorf("BackendRouterConfig %s : backend %s configured more than once", name, beConfig.Host)
+			}
+			backendHosts[beConfig.Host] = true
+
+			u, err := url.Parse(beConfig.Host)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("BackendRouterConfig %s : backend host %s is not a valid URL", name, beConfig.Host)
+			}
+
+			if beConfig.MaxConnections < 0 {
+				return fmt.Errorf("BackendRouterConfig %s : backend %s maxconnections cannot be negative", name, beConfig.Host)
+			}
+
+			if beConfig.Weight < 0 {
+				return fmt.Errorf("BackendRouterConfig %s : backend %s weight cannot be negative", name, beConfig.Host)
+			}
+		}
+	}
+
+	return c.validateRouterReferences()
 }
 
 // LoadConfig, loads configuation for LBLight. Primarily backend host, port, paths etc.
-func LoadConfig(filePath string) Config {
+// The format is determined by the file extension: .yaml/.yml for YAML, .toml for TOML, otherwise JSON.
+// ${VAR} and ${VAR:-default} are replaced with environment variables before parsing, and any
+// files listed in Include are merged in. The config is validated before being returned.
+func LoadConfig(filePath string) (Config, error) {
 	var config Config
-	configFile, err := os.Open(filePath)
-	defer configFile.Close()
+	err := readConfigFile(filePath, &config)
+	if err != nil {
+		return config, err
+	}
+
+	err = mergeIncludes(filePath, &config)
 	if err != nil {
-		fmt.Println(err.Error())
+		return config, err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return config, fmt.Errorf("Invalid config %s : %s", filePath, err.Error())
+	}
+
+	return config, nil
+}
+
+// decodeConfig decodes data into v. YAML and TOML are converted to JSON first, so
+// all formats share the same field names (case insensitive) and decoding rules.
+func decodeConfig(filePath string, data []byte, v interface{}) error {
+	var err error
+	switch configFormat(filePath) {
+	case configFormatYAML:
+		var raw interface{}
+		err = yaml.Unmarshal(data, &raw)
+		if err != nil {
+			return err
+		}
+		data, err = json.Marshal(convertYAMLToJSONCompatible(raw))
+
+	case configFormatTOML:
+		var raw map[string]interface{}
+		err = toml.Unmarshal(data, &raw)
+		if err != nil {
+			return err
+		}
+		data, err = json.Marshal(raw)
+	}
+
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// convertYAMLToJSONCompatible converts the map[interface{}]interface{} maps the YAML decoder generates
+// into map[string]interface{} so they can be marshalled to JSON.
+func convertYAMLToJSONCompatible(raw interface{}) interface{} {
+	switch v := raw.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for key, val := range v {
+			m[fmt.Sprintf("%v", key)] = convertYAMLToJSONCompatible(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range v {
+			v[i] = convertYAMLToJSONCompatible(val)
+		}
+		return v
 	}
-	jsonParser := json.NewDecoder(configFile)
-	jsonParser.Decode(&config)
-	return config
+	return raw
 }
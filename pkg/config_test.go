@@ -0,0 +1,206 @@
+package pkg
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testJSONConfig = `{
+  "Port": 4000,
+  "HealthCheckTimerInSeconds": 5,
+  "BackendRouterConfigs": [
+    {
+      "SelectionMethod": "RoundRobin",
+      "AcceptedPaths": ["/foo"],
+      "AcceptedHeaders": {"X-Node": "A"},
+      "BackendConfigs": [{"host": "http://10.0.0.1:5000", "port": 5000, "maxconnections": 100}]
+    }
+  ]
+}`
+
+const testYAMLConfig = `
+Port: 4000
+HealthCheckTimerInSeconds: 5
+BackendRouterConfigs:
+  - SelectionMethod: RoundRobin
+    AcceptedPaths:
+      - /foo
+    AcceptedHeaders:
+      X-Node: A
+    BackendConfigs:
+      - host: http://10.0.0.1:5000
+        port: 5000
+        maxconnections: 100
+`
+
+const testTOMLConfig = `
+Port = 4000
+HealthCheckTimerInSeconds = 5
+
+[[BackendRouterConfigs]]
+SelectionMethod = "RoundRobin"
+AcceptedPaths = ["/foo"]
+AcceptedHeaders = { X-Node = "A" }
+
+  [[BackendRouterConfigs.BackendConfigs]]
+  host = "http://10.0.0.1:5000"
+  port = 5000
+  maxconnections = 100
+`
+
+func writeTestConfig(t *testing.T, fileName string, contents string) string {
+	filePath := filepath.Join(t.TempDir(), fileName)
+	err := ioutil.WriteFile(filePath, []byte(contents), 0644)
+	assert.Nil(t, err, "Unable to write test config")
+	return filePath
+}
+
+func TestLoadConfigAllFormatsMatch(t *testing.T) {
+	jsonConfig, err := LoadConfig(writeTestConfig(t, "lblight.json", testJSONConfig))
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, 4000, jsonConfig.Port)
+	assert.Equal(t, "A", jsonConfig.BackendRouterConfigs[0].AcceptedHeaders["X-Node"])
+
+	yamlConfig, err := LoadConfig(writeTestConfig(t, "lblight.yaml", testYAMLConfig))
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, jsonConfig, yamlConfig)
+
+	tomlConfig, err := LoadConfig(writeTestConfig(t, "lblight.toml", testTOMLConfig))
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, jsonConfig, tomlConfig)
+}
+
+func TestLoadConfigInvalidYAML(t *testing.T) {
+	_, err := LoadConfig(writeTestConfig(t, "lblight.yml", "Port: [4000"))
+	assert.NotNil(t, err, "Expected parse error")
+}
+
+func TestLoadConfigValidationFailsForAllFormats(t *testing.T) {
+	for fileName, contents := range map[string]string{"lblight.json": `{"Port": 4000}`, "lblight.yaml": "Port: 4000", "lblight.toml": "Port = 4000"} {
+		filePath := writeTestConfig(t, fileName, contents)
+		_, err := LoadConfig(filePath)
+		assert.EqualError(t, err, "Invalid config "+filePath+" : No BackendRouterConfigs configured")
+	}
+}
+
+func TestInterpolateEnvVars(t *testing.T) {
+	os.Setenv("LBLIGHT_TEST_HOST", "10.0.0.5")
+	defer os.Unsetenv("LBLIGHT_TEST_HOST")
+	os.Unsetenv("LBLIGHT_TEST_UNSET")
+
+	result, err := interpolateEnvVars([]byte(`${LBLIGHT_TEST_HOST}:${LBLIGHT_TEST_UNSET:-5000}/${LBLIGHT_TEST_UNSET}$${LBLIGHT_TEST_HOST}`), configFormatJSON)
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, "10.0.0.5:5000/${LBLIGHT_TEST_HOST}", string(result))
+}
+
+func TestInterpolateEnvVarsEscapesJSON(t *testing.T) {
+	os.Setenv("LBLIGHT_TEST_TOKEN", `a"b\c", "AdminPort": 1`)
+	defer os.Unsetenv("LBLIGHT_TEST_TOKEN")
+	os.Setenv("LBLIGHT_TEST_PORT", "4001")
+	defer os.Unsetenv("LBLIGHT_TEST_PORT")
+
+	result, err := interpolateEnvVars([]byte(`{"AdminToken": "x\"${LBLIGHT_TEST_TOKEN}", "port": ${LBLIGHT_TEST_PORT}}`), configFormatJSON)
+	assert.Nil(t, err, "Error not expected")
+	var config Config
+	err = json.Unmarshal(result, &config)
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, `x"a"b\c", "AdminPort": 1`, config.AdminToken)
+	assert.Equal(t, 0, config.AdminPort, "Expected value not to add keys")
+	assert.Equal(t, 4001, config.Port, "Expected values outside strings not to be escaped")
+
+	_, err = interpolateEnvVars([]byte(`{"port": ${LBLIGHT_TEST_TOKEN}}`), configFormatJSON)
+	assert.NotNil(t, err, "Expected error for value that isn't a plain token outside a string")
+}
+
+// testInjectedToken tries to break out of any kind of string and add AdminPort.
+const testInjectedToken = "a\"b\\c'd\nAdminPort: 1\nAdminPort = 1\n: x"
+
+func TestInterpolateEnvVarsEscapesYAML(t *testing.T) {
+	os.Setenv("LBLIGHT_TEST_TOKEN", testInjectedToken)
+	defer os.Unsetenv("LBLIGHT_TEST_TOKEN")
+	os.Setenv("LBLIGHT_TEST_PORT", "4001")
+	defer os.Unsetenv("LBLIGHT_TEST_PORT")
+
+	data := `
+# token is ${LBLIGHT_TEST_TOKEN}
+Port: ${LBLIGHT_TEST_PORT}
+Host: it's here
+AdminToken: "x\"${LBLIGHT_TEST_TOKEN}"
+CertCrtPath: 'it''s ${LBLIGHT_TEST_TOKEN}'
+`
+	result, err := interpolateEnvVars([]byte(data), configFormatYAML)
+	assert.Nil(t, err, "Error not expected")
+	var config Config
+	err = decodeConfig("lblight.yaml", result, &config)
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, 4001, config.Port)
+	assert.Equal(t, "it's here", config.Host)
+	assert.Equal(t, `x"`+testInjectedToken, config.AdminToken)
+	assert.Equal(t, "it's "+strings.Replace(testInjectedToken, "\n", " ", -1), config.CertCrtPath, "Expected line breaks folded in single quoted string")
+	assert.Equal(t, 0, config.AdminPort, "Expected value not to add keys")
+
+	_, err = interpolateEnvVars([]byte("AdminToken: ${LBLIGHT_TEST_TOKEN}\n"), configFormatYAML)
+	assert.NotNil(t, err, "Expected error for value that isn't a plain token outside a string")
+}
+
+func TestInterpolateEnvVarsEscapesTOML(t *testing.T) {
+	os.Setenv("LBLIGHT_TEST_TOKEN", testInjectedToken)
+	defer os.Unsetenv("LBLIGHT_TEST_TOKEN")
+	os.Setenv("LBLIGHT_TEST_PORT", "4001")
+	defer os.Unsetenv("LBLIGHT_TEST_PORT")
+
+	data := `
+# token is ${LBLIGHT_TEST_TOKEN}
+Port = ${LBLIGHT_TEST_PORT}
+AdminToken = "x\"${LBLIGHT_TEST_TOKEN}"
+CertCrtPath = """multi "${LBLIGHT_TEST_TOKEN}" line"""
+Host = 'it"s ${LBLIGHT_TEST_PORT}'
+`
+	result, err := interpolateEnvVars([]byte(data), configFormatTOML)
+	assert.Nil(t, err, "Error not expected")
+	var config Config
+	err = decodeConfig("lblight.toml", result, &config)
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, 4001, config.Port)
+	assert.Equal(t, `x"`+testInjectedToken, config.AdminToken)
+	assert.Equal(t, `multi "`+testInjectedToken+`" line`, config.CertCrtPath)
+	assert.Equal(t, `it"s 4001`, config.Host)
+	assert.Equal(t, 0, config.AdminPort, "Expected value not to add keys")
+
+	_, err = interpolateEnvVars([]byte("AdminToken = ${LBLIGHT_TEST_TOKEN}\n"), configFormatTOML)
+	assert.NotNil(t, err, "Expected error for value that isn't a plain token outside a string")
+	_, err = interpolateEnvVars([]byte("AdminToken = '${LBLIGHT_TEST_TOKEN}'\n"), configFormatTOML)
+	assert.NotNil(t, err, "Expected error for value with a quote in a literal string")
+}
+
+func TestLoadConfigWithIncludes(t *testing.T) {
+	os.Setenv("LBLIGHT_TEST_PORT", "4001")
+	defer os.Unsetenv("LBLIGHT_TEST_PORT")
+
+	dir := t.TempDir()
+	err := os.Mkdir(filepath.Join(dir, "routers"), 0755)
+	assert.Nil(t, err, "Unable to create include dir")
+
+	err = ioutil.WriteFile(filepath.Join(dir, "lblight.json"), []byte(`{"Port": ${LBLIGHT_TEST_PORT:-4000}, "Include": ["routers"]}`), 0644)
+	assert.Nil(t, err, "Unable to write test config")
+	err = ioutil.WriteFile(filepath.Join(dir, "routers", "team1.yaml"), []byte(testYAMLConfig), 0644)
+	assert.Nil(t, err, "Unable to write test config")
+	err = ioutil.WriteFile(filepath.Join(dir, "routers", "README.txt"), []byte("not config"), 0644)
+	assert.Nil(t, err, "Unable to write test config")
+
+	config, err := LoadConfig(filepath.Join(dir, "lblight.json"))
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, 4001, config.Port)
+	assert.Equal(t, 1, len(config.BackendRouterConfigs))
+	assert.Equal(t, []string{"/foo"}, config.BackendRouterConfigs[0].AcceptedPaths)
+}
+
+func TestLoadConfigMissingInclude(t *testing.T) {
+	_, err := LoadConfig(writeTestConfig(t, "lblight.json", `{"Include": ["missing/*.json"]}`))
+	assert.NotNil(t, err, "Expected missing include error")
+}
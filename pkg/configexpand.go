@@ -0,0 +1,323 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	configFormatJSON string = "json"
+	configFormatYAML string = "yaml"
+	configFormatTOML string = "toml"
+)
+
+// matches ${VAR}, ${VAR:-default} and $${...} (escaped, left as ${...})
+var envVarRegex = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// values that can be substituted outside a string in any format without changing the structure of the
+// config (numbers, booleans, hosts, URLs, tokens).
+var unquotedValueRegex = regexp.MustCompile(`^[A-Za-z0-9_.:/+=@~-]*$`)
+
+// configFileExtensions are the files picked up when an include refers to a directory.
+var configFileExtensions = map[string]bool{".json": true, ".yaml": true, ".yml": true, ".toml": true}
+
+// configFragment is the contents of an included config file. Only BackendRouterConfigs can be
+// supplied by includes, everything else comes from the main config file.
+type configFragment struct {
+	BackendRouterConfigs []BackendRouterConfig `json:"BackendRouterConfigs"`
+}
+
+// interpolateEnvVars replaces ${VAR} with the value of environment variable VAR. ${VAR:-default}
+// uses default if VAR is unset or empty. $${VAR} is an escape and becomes a literal ${VAR}.
+// Values are escaped to suit the string they're substituted into, so quotes, backslashes or line breaks
+// in the environment can't break the config or add to it. Outside a string a value must be a plain
+// token (number, host, URL etc). Defaults are config text already, so aren't escaped. References in
+// comments are left alone.
+func interpolateEnvVars(data []byte, format string) ([]byte, error) {
+	var out []byte
+	scanner := configScanner{data: data, format: format}
+	last := 0
+	for _, loc := range envVarRegex.FindAllIndex(data, -1) {
+		scanner.advance(loc[0])
+		val := data[loc[0]:loc[1]]
+		if !scanner.comment {
+			var err error
+			val, err = expandEnvVar(val, scanner.state)
+			if err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, data[last:loc[0]]...)
+		out = append(out, val...)
+		scanner.advance(loc[1])
+		last = loc[1]
+	}
+	return append(out, data[last:]...), nil
+}
+
+// expandEnvVar returns the replacement for a single ${VAR} match, escaped for the string it's in.
+func expandEnvVar(match []byte, state quoteState) ([]byte, error) {
+	if strings.HasPrefix(string(match), "$$") {
+		return match[1:], nil
+	}
+
+	parts := envVarRegex.FindSubmatch(match)
+	name := string(parts[1])
+	val := os.Getenv(name)
+	if val == "" && len(parts[2]) > 0 {
+		return parts[3], nil
+	}
+
+	switch state {
+	case doubleQuoted:
+		encoded, _ := json.Marshal(val)
+		return encoded[1 : len(encoded)-1], nil
+	case singleQuoted:
+		return []byte(strings.Replace(val, "'", "''", -1)), nil
+	case literalQuoted:
+		if strings.ContainsAny(val, "'\r\n") {
+			return nil, fmt.Errorf("Environment variable %s contains a quote or line break so can't be used in a literal string, use a basic (double quoted) string", name)
+		}
+		return []byte(val), nil
+	}
+
+	if !unquotedValueRegex.MatchString(val) {
+		return nil, fmt.Errorf("Environment variable %s contains characters that could change the config so must be used inside a quoted string", name)
+	}
+	return []byte(val), nil
+}
+
+// quoteState is the kind of string a position in the config is inside, if any.
+type quoteState int
+
+const (
+	notQuoted quoteState = iota
+
+	// JSON, YAML and TOML "..." (and TOML """..."""), with backslash escapes.
+	doubleQuoted
+
+	// YAML '...', where '' is a quote.
+	singleQuoted
+
+	// TOML '...' and '''...''', which have no escapes at all.
+	literalQuoted
+)
+
+// configScanner tracks whether the config text scanned so far ends inside a string or a comment.
+type configScanner struct {
+	data   []byte
+	format string
+	pos    int
+
+	state     quoteState
+	multiLine bool
+	escaped   bool
+	comment   bool
+
+	// YAML only: a quote only starts a string at the start of a scalar, so track the last non-blank
+	// character on the line (0 at the start of a line) and whether we're in a flow collection.
+	prev      byte
+	flowDepth int
+}
+
+// advance scans up to (not including) end.
+func (s *configScanner) advance(end int) {
+	for ; s.pos < end; s.pos++ {
+		c := s.data[s.pos]
+		switch {
+		case s.state != notQuoted:
+			s.scanQuoted(c)
+		case s.comment:
+			if c == '\n' {
+				s.comment = false
+				s.prev = 0
+			}
+		case s.format == configFormatYAML:
+			s.scanYAML(c)
+		case s.format == configFormatTOML:
+			s.scanTOML(c)
+		case c == '"':
+			s.state = doubleQuoted
+		}
+	}
+}
+
+func (s *configScanner) scanQuoted(c byte) {
+	switch {
+	case s.escaped:
+		s.escaped = false
+	case c == '\\' && s.state == doubleQuoted:
+		s.escaped = true
+	case c == '\'' && s.state == singleQuoted && s.peek(1) == '\'':
+		s.pos++
+	case (c == '"' && s.state == doubleQuoted) || (c == '\'' && s.state != doubleQuoted):
+		if s.multiLine {
+			if s.peek(1) != c || s.peek(2) != c {
+				return
+			}
+			s.pos += 2
+		}
+		s.state = notQuoted
+		s.prev = c
+	}
+}
+
+func (s *configScanner) scanTOML(c byte) {
+	switch c {
+	case '#':
+		s.comment = true
+	case '"', '\'':
+		s.state = doubleQuoted
+		if c == '\'' {
+			s.state = literalQuoted
+		}
+		s.multiLine = s.peek(1) == c && s.peek(2) == c
+		if s.multiLine {
+			s.pos += 2
+		}
+	}
+}
+
+func (s *configScanner) scanYAML(c byte) {
+	blankBefore := s.pos == 0 || isBlank(s.data[s.pos-1])
+	switch {
+	case c == '\n':
+		s.prev = 0
+		return
+	case isBlank(c):
+		return
+	case c == '#' && blankBefore:
+		s.comment = true
+		return
+	case c == '"' && s.startsScalar(blankBefore):
+		s.state = doubleQuoted
+	case c == '\'' && s.startsScalar(blankBefore):
+		s.state = singleQuoted
+	case c == '[' || c == '{':
+		s.flowDepth++
+	case (c == ']' || c == '}') && s.flowDepth > 0:
+		s.flowDepth--
+	}
+	s.prev = c
+}
+
+// startsScalar returns true if a YAML scalar can start at the current position.
+func (s *configScanner) startsScalar(blankBefore bool) bool {
+	switch s.prev {
+	case 0, '[', '{', ',':
+		return true
+	case ':':
+		return blankBefore || s.flowDepth > 0
+	case '-', '?':
+		return blankBefore
+	}
+	return false
+}
+
+// peek returns the character n after the current position, or 0 past the end.
+func (s *configScanner) peek(n int) byte {
+	if s.pos+n >= len(s.data) {
+		return 0
+	}
+	return s.data[s.pos+n]
+}
+
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// configFormat returns how filePath is decoded (see decodeConfig), based on its extension.
+func configFormat(filePath string) string {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".yaml", ".yml":
+		return configFormatYAML
+	case ".toml":
+		return configFormatTOML
+	}
+	return configFormatJSON
+}
+
+// readConfigFile reads filePath and decodes it (after env var interpolation) into v.
+func readConfigFile(filePath string, v interface{}) error {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	data, err = interpolateEnvVars(data, configFormat(filePath))
+	if err == nil {
+		err = decodeConfig(filePath, data, v)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to parse config %s : %s", filePath, err.Error())
+	}
+	return nil
+}
+
+// ResolveIncludes returns the list of files referred to by includes. Each include can be a file,
+// a glob pattern or a directory (all .json/.yaml/.yml/.toml files in it). Relative paths are relative
+// to the directory of the main config file configPath. Files are returned in a stable (sorted) order
+// per include.
+func ResolveIncludes(configPath string, includes []string) ([]string, error) {
+	var files []string
+	baseDir := filepath.Dir(configPath)
+	for _, include := range includes {
+		pattern := include
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(baseDir, pattern)
+		}
+
+		fi, err := os.Stat(pattern)
+		if err == nil && fi.IsDir() {
+			entries, err := ioutil.ReadDir(pattern)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, entry := range entries {
+				if !entry.IsDir() && configFileExtensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+					files = append(files, filepath.Join(pattern, entry.Name()))
+				}
+			}
+			continue
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid include %s : %s", include, err.Error())
+		}
+
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("Include %s did not match any files", include)
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+
+	return files, nil
+}
+
+// mergeIncludes loads every file in config.Include and appends its BackendRouterConfigs to config.
+func mergeIncludes(configPath string, config *Config) error {
+	files, err := ResolveIncludes(configPath, config.Include)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		var fragment configFragment
+		err = readConfigFile(file, &fragment)
+		if err != nil {
+			return err
+		}
+		config.BackendRouterConfigs = append(config.BackendRouterConfigs, fragment.BackendRouterConfigs...)
+	}
+
+	return nil
+}
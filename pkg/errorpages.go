@@ -0,0 +1,266 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	errorFormatText string = "text"
+	errorFormatHTML string = "html"
+	errorFormatJSON string = "json"
+
+	// sent to clients asking for JSON when there's no JSON page configured.
+	defaultErrorJSON string = `{"status": {status}, "error": "{message}", "request_id": "{request_id}"}`
+)
+
+// ErrorPagesConfig sets the responses sent for errors LBLight generates (404, 429, 503 etc), and optionally
+// for 5xx responses from the backends.
+type ErrorPagesConfig struct {
+	// keyed by status code ("503") or class ("5xx").
+	Pages map[string]ErrorPageConfig `json:"pages,omitempty"`
+
+	// replace 5xx responses from the backends with the error page.
+	InterceptBackendErrors bool `json:"interceptbackenderrors,omitempty"`
+}
+
+// ErrorPageConfig is the page for a status. HTMLFile is sent to clients that accept HTML, JSON to clients
+// that accept JSON, otherwise the plain error message is sent. Both can use {status}, {status_text},
+// {message}, {request_id}, {router}, {method} and {path}, which are escaped to suit.
+type ErrorPageConfig struct {
+	HTMLFile string `json:"htmlfile,omitempty"`
+	JSON     string `json:"json,omitempty"`
+}
+
+// Validate checks the status codes and reads the HTML files.
+func (c ErrorPagesConfig) Validate() error {
+	_, err := newErrorPages(c)
+	return err
+}
+
+// errorPages are the loaded pages for a router, or for LBLight as a whole.
+type errorPages struct {
+	pages     map[string]errorPage
+	intercept bool
+}
+
+type errorPage struct {
+	html string
+	json string
+}
+
+// newErrorPages loads the pages in config. Returns nil if nothing is configured.
+func newErrorPages(config ErrorPagesConfig) (*errorPages, error) {
+	if len(config.Pages) == 0 && !config.InterceptBackendErrors {
+		return nil, nil
+	}
+
+	ep := errorPages{pages: make(map[string]errorPage), intercept: config.InterceptBackendErrors}
+	for key, pageConfig := range config.Pages {
+		key = strings.ToLower(key)
+		if !isValidErrorPageKey(key) {
+			return nil, fmt.Errorf("Invalid error page status %s, must be a code (eg. 503) or class (eg. 5xx)", key)
+		}
+
+		page := errorPage{json: pageConfig.JSON}
+		if pageConfig.HTMLFile != "" {
+			contents, err := ioutil.ReadFile(pageConfig.HTMLFile)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read error page %s : %s", pageConfig.HTMLFile, err.Error())
+			}
+			page.html = string(contents)
+		}
+		ep.pages[key] = page
+	}
+	return &ep, nil
+}
+
+// isValidErrorPageKey checks key is a 4xx/5xx status code or class.
+func isValidErrorPageKey(key string) bool {
+	if len(key) != 3 || (key[0] != '4' && key[0] != '5') {
+		return false
+	}
+	if key[1:] == "xx" {
+		return true
+	}
+	return key[1] >= '0' && key[1] <= '9' && key[2] >= '0' && key[2] <= '9'
+}
+
+// getPage returns the page for status, preferring an exact match over the class.
+func (ep *errorPages) getPage(status int) (errorPage, bool) {
+	if ep == nil {
+		return errorPage{}, false
+	}
+	code := strconv.Itoa(status)
+	if page, ok := ep.pages[code]; ok {
+		return page, true
+	}
+	page, ok := ep.pages[code[:1]+"xx"]
+	return page, ok
+}
+
+// errorPageFor returns the page for status. The router's pages are checked before the global ones.
+func (ri *requestInfo) errorPageFor(status int) errorPage {
+	if ri == nil {
+		return errorPage{}
+	}
+	if ri.router != nil {
+		if page, ok := ri.router.errorPages.getPage(status); ok {
+			return page
+		}
+	}
+	page, _ := ri.errorPages.getPage(status)
+	return page
+}
+
+// interceptBackendErrors returns true if 5xx responses from the backend should be replaced.
+func (ri *requestInfo) interceptBackendErrors() bool {
+	if ri == nil {
+		return false
+	}
+	if ri.router != nil && ri.router.errorPages != nil && ri.router.errorPages.intercept {
+		return true
+	}
+	return ri.errorPages != nil && ri.errorPages.intercept
+}
+
+// renderErrorPage returns the content type and body for an error, in the format the client prefers.
+func renderErrorPage(req *http.Request, info *requestInfo, status int, message string) (string, []byte) {
+	page := info.errorPageFor(status)
+
+	jsonPage := page.json
+	if jsonPage == "" && acceptsExplicitly(req.Header.Get("Accept"), "application/json") {
+		jsonPage = defaultErrorJSON
+	}
+
+	switch negotiateErrorFormat(req.Header.Get("Accept"), page.html != "", jsonPage != "") {
+	case errorFormatHTML:
+		return "text/html; charset=utf-8", []byte(expandErrorPage(page.html, req, info, status, message, html.EscapeString))
+	case errorFormatJSON:
+		return "application/json", []byte(expandErrorPage(jsonPage, req, info, status, message, jsonEscape))
+	}
+	return "text/plain; charset=utf-8", []byte(message + "\n")
+}
+
+// writeError sends an error generated by LBLight to the client, using the configured error page if there is one.
+func writeError(res http.ResponseWriter, req *http.Request, status int, message string) {
+	contentType, body := renderErrorPage(req, getRequestInfo(req), status, message)
+	res.Header().Set("Content-Type", contentType)
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	res.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	res.WriteHeader(status)
+	res.Write(body)
+}
+
+// replaceBackendError swaps the body of a 5xx response from a backend for the error page.
+func replaceBackendError(resp *http.Response, info *requestInfo) {
+	contentType, body := renderErrorPage(resp.Request, info, resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("X-Content-Type-Options", "nosniff")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// negotiateErrorFormat picks HTML or JSON (whichever are available) based on the Accept header, falling
+// back to plain text if the client accepts neither. HTML wins a tie.
+func negotiateErrorFormat(accept string, hasHTML bool, hasJSON bool) string {
+	htmlQ, jsonQ := 0.0, 0.0
+	if hasHTML {
+		htmlQ, _ = acceptQuality(accept, "text/html")
+	}
+	if hasJSON {
+		jsonQ, _ = acceptQuality(accept, "application/json")
+	}
+
+	switch {
+	case jsonQ > htmlQ:
+		return errorFormatJSON
+	case htmlQ > 0:
+		return errorFormatHTML
+	}
+	return errorFormatText
+}
+
+// acceptsExplicitly returns true if accept names mediaType itself (not through a wildcard).
+func acceptsExplicitly(accept string, mediaType string) bool {
+	q, explicit := acceptQuality(accept, mediaType)
+	return explicit && q > 0
+}
+
+// acceptQuality returns the q value accept gives mediaType, from the most specific range that matches it.
+// explicit is true if the range was mediaType itself. An empty Accept accepts everything.
+func acceptQuality(accept string, mediaType string) (float64, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return 1, false
+	}
+
+	mainType := strings.SplitN(mediaType, "/", 2)[0]
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		rangeType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		rangeSpecificity := -1
+		switch rangeType {
+		case mediaType:
+			rangeSpecificity = 2
+		case mainType + "/*":
+			rangeSpecificity = 1
+		case "*/*":
+			rangeSpecificity = 0
+		}
+		if rangeSpecificity <= specificity {
+			continue
+		}
+
+		specificity = rangeSpecificity
+		q = 1
+		if val, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(val, 64)
+			if err != nil {
+				q = 0
+			}
+		}
+	}
+	return q, specificity == 2
+}
+
+// expandErrorPage fills in the placeholders in page. Braces that aren't a placeholder are left alone, as
+// JSON templates are full of them.
+func expandErrorPage(page string, req *http.Request, info *requestInfo, status int, message string, escape func(string) string) string {
+	var requestID, router string
+	if info != nil {
+		requestID = info.requestID
+		router = info.routerName()
+	}
+
+	replacer := strings.NewReplacer(
+		"{status}", strconv.Itoa(status),
+		"{status_text}", escape(http.StatusText(status)),
+		"{message}", escape(message),
+		"{request_id}", escape(requestID),
+		"{router}", escape(router),
+		"{method}", escape(req.Method),
+		"{path}", escape(req.URL.Path),
+	)
+	return replacer.Replace(page)
+}
+
+// jsonEscape escapes s for use inside a JSON string.
+func jsonEscape(s string) string {
+	encoded, _ := json.Marshal(s)
+	return string(encoded[1 : len(encoded)-1])
+}
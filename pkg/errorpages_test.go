@@ -0,0 +1,124 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestNegotiateErrorFormat(t *testing.T) {
+	tests := []struct {
+		accept   string
+		hasHTML  bool
+		hasJSON  bool
+		expected string
+	}{
+		{"", true, true, errorFormatHTML},
+		{"", false, true, errorFormatJSON},
+		{"", false, false, errorFormatText},
+		{"application/json", true, true, errorFormatJSON},
+		{"text/html,application/xhtml+xml,*/*;q=0.8", true, true, errorFormatHTML},
+		{"application/json;q=0.5, text/html;q=0.9", true, true, errorFormatHTML},
+		{"application/json, text/html;q=0.9", true, true, errorFormatJSON},
+		{"*/*", false, true, errorFormatJSON},
+		{"text/html;q=0, */*", true, false, errorFormatText},
+		{"image/png", true, true, errorFormatText},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, negotiateErrorFormat(test.accept, test.hasHTML, test.hasJSON), "Accept %s", test.accept)
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	htmlFile := filepath.Join(t.TempDir(), "503.html")
+	err := ioutil.WriteFile(htmlFile, []byte("<p>{status} {message} {request_id} {path}</p>"), 0644)
+	assert.Nil(t, err, "Error not expected")
+
+	config := generateTestConfig("/foo", "/bar")
+	config.BackendRouterConfigs[0].BackendConfigs = nil
+	config.BackendRouterConfigs[1].BackendConfigs = nil
+	config.ErrorPages = ErrorPagesConfig{Pages: map[string]ErrorPageConfig{
+		"5xx": {HTMLFile: htmlFile, JSON: `{"code": {status}, "message": "{message}", "id": "{request_id}"}`},
+	}}
+	config.BackendRouterConfigs[1].ErrorPages = ErrorPagesConfig{Pages: map[string]ErrorPageConfig{
+		"503": {JSON: `{"router": "{router}"}`},
+	}}
+	lbl := NewLBLight(4000, false)
+	err = lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+
+	request := func(path string, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(RequestIDHeader, "abc")
+		req.Header.Set("Accept", accept)
+		res := httptest.NewRecorder()
+		lbl.handleRequestsAndRedirect(res, req)
+		return res
+	}
+
+	res := request("/foo/<x>", "text/html")
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.Equal(t, "text/html; charset=utf-8", res.Header().Get("Content-Type"))
+	assert.Equal(t, "<p>503 Service not available abc /foo/&lt;x&gt;</p>", res.Body.String())
+
+	res = request("/foo", "application/json")
+	assert.Equal(t, "application/json", res.Header().Get("Content-Type"))
+	assert.Equal(t, `{"code": 503, "message": "Service not available", "id": "abc"}`, res.Body.String())
+
+	res = request("/bar", "application/json")
+	assert.Equal(t, `{"router": "/bar"}`, res.Body.String(), "Expected router page before global page")
+
+	res = request("/bar", "text/plain")
+	assert.Equal(t, "Service not available\n", res.Body.String(), "Expected plain text if page has no HTML")
+
+	res = request("/nothere", "application/json")
+	assert.Equal(t, http.StatusNotFound, res.Code)
+	assert.Equal(t, `{"status": 404, "error": "Not found", "request_id": "abc"}`, res.Body.String(), "Expected default JSON without a 404 page")
+}
+
+func TestInterceptBackendErrors(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("stack trace \"here\""))
+	}))
+	defer backend.Close()
+
+	config := generateTestConfig("/foo")
+	config.BackendRouterConfigs[0].BackendConfigs[0].Host = backend.URL
+	config.ErrorPages = ErrorPagesConfig{InterceptBackendErrors: true}
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.Header.Set(RequestIDHeader, "abc")
+	req.Header.Set("Accept", "application/json")
+	res := httptest.NewRecorder()
+	lbl.handleRequestsAndRedirect(res, req)
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+	assert.Equal(t, "application/json", res.Header().Get("Content-Type"))
+	assert.Equal(t, `{"status": 500, "error": "Internal Server Error", "request_id": "abc"}`, res.Body.String())
+}
+
+func TestErrorPagesValidation(t *testing.T) {
+	valid := ErrorPagesConfig{Pages: map[string]ErrorPageConfig{"404": {JSON: "{}"}, "5XX": {JSON: "{}"}}}
+	assert.Nil(t, valid.Validate(), "Error not expected")
+
+	invalid := []ErrorPagesConfig{
+		{Pages: map[string]ErrorPageConfig{"200": {JSON: "{}"}}},
+		{Pages: map[string]ErrorPageConfig{"5x": {JSON: "{}"}}},
+		{Pages: map[string]ErrorPageConfig{"5ab": {JSON: "{}"}}},
+		{Pages: map[string]ErrorPageConfig{"500": {HTMLFile: "/does/not/exist.html"}}},
+	}
+	for _, config := range invalid {
+		assert.NotNil(t, config.Validate(), "Expected error for %v", config)
+	}
+}
+
+func TestJSONEscape(t *testing.T) {
+	assert.Equal(t, `a \"b\" \\ \n`, jsonEscape("a \"b\" \\ \n"))
+}
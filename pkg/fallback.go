@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	DefaultNotFoundContentType string = "text/plain; charset=utf-8"
+)
+
+// NotFoundConfig is the response sent when no router matches a request (and there's no DefaultRouter).
+// Without a Body the 404 error page is used.
+type NotFoundConfig struct {
+	Body        string `json:"body,omitempty"`
+	ContentType string `json:"contenttype,omitempty"`
+}
+
+// GetContentType returns the configured content type, or the default if not set.
+func (c NotFoundConfig) GetContentType() string {
+	if c.ContentType == "" {
+		return DefaultNotFoundContentType
+	}
+	return c.ContentType
+}
+
+// writeNotFound sends the configured 404 response, or the 404 error page if there's no NotFound body.
+func (l *LBLight) writeNotFound(res http.ResponseWriter, req *http.Request) {
+	l.routesMux.RLock()
+	notFound := l.notFound
+	l.routesMux.RUnlock()
+
+	requestLog(req).Warnf("No router for %s %s", req.Host, req.RequestURI)
+	l.metrics.observeRejection("", http.StatusNotFound)
+	if notFound.Body == "" {
+		writeError(res, req, http.StatusNotFound, "Not found")
+		return
+	}
+
+	res.Header().Set("Content-Type", notFound.GetContentType())
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	res.WriteHeader(http.StatusNotFound)
+	fmt.Fprint(res, notFound.Body)
+}
+
+// getBackendOrFallback picks a backend from the router. If none of its backends are available then the
+// FallbackRouter is tried (and its fallback, and so on). Returns the router the backend came from.
+func (ber *BackendRouter) getBackendOrFallback() (*Backend, *BackendRouter, error) {
+	router := ber
+	visited := make(map[*BackendRouter]bool)
+	for {
+		backend, err := router.GetBackend()
+		if err == nil {
+			return backend, router, nil
+		}
+
+		// config validation stops loops, but don't rely on it.
+		visited[router] = true
+		if router.fallback == nil || visited[router.fallback] {
+			return nil, ber, err
+		}
+		router = router.fallback
+	}
+}
+
+// validateRouterReferences checks DefaultRouter and every FallbackRouter name an existing router, and that
+// fallbacks don't loop back on themselves.
+func (c Config) validateRouterReferences() error {
+	fallbacks := make(map[string]string)
+	for _, berConfig := range c.BackendRouterConfigs {
+		fallbacks[berConfig.RouterName()] = berConfig.FallbackRouter
+	}
+
+	if _, ok := fallbacks[c.DefaultRouter]; c.DefaultRouter != "" && !ok {
+		return fmt.Errorf("DefaultRouter %s is not a configured router", c.DefaultRouter)
+	}
+
+	for name, fallback := range fallbacks {
+		if fallback == "" {
+			continue
+		}
+		if _, ok := fallbacks[fallback]; !ok {
+			return fmt.Errorf("BackendRouterConfig %s : FallbackRouter %s is not a configured router", name, fallback)
+		}
+
+		visited := map[string]bool{name: true}
+		for next := fallback; next != ""; next = fallbacks[next] {
+			if visited[next] {
+				return fmt.Errorf("BackendRouterConfig %s : FallbackRouter %s leads back to a router already tried", name, fallback)
+			}
+			visited[next] = true
+		}
+	}
+	return nil
+}
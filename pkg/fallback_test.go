@@ -0,0 +1,99 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotFound(t *testing.T) {
+	config := generateTestConfig("/foo")
+	config.NotFound = NotFoundConfig{Body: `{"error":"no route"}`, ContentType: "application/json"}
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+
+	res := httptest.NewRecorder()
+	lbl.handleRequestsAndRedirect(res, httptest.NewRequest(http.MethodGet, "/nothere", nil))
+	assert.Equal(t, http.StatusNotFound, res.Code)
+	assert.Equal(t, "application/json", res.Header().Get("Content-Type"))
+	assert.Equal(t, `{"error":"no route"}`, res.Body.String())
+
+	lbl = generateTestLBLight(t, "http://10.0.0.1:5000")
+	res = httptest.NewRecorder()
+	lbl.handleRequestsAndRedirect(res, httptest.NewRequest(http.MethodGet, "/nothere", nil))
+	assert.Equal(t, http.StatusNotFound, res.Code)
+	assert.Equal(t, "Not found\n", res.Body.String())
+}
+
+func TestDefaultAndFallbackRouters(t *testing.T) {
+	var served string
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			served = name
+		}))
+	}
+	primary := newBackend("primary")
+	defer primary.Close()
+	backup := newBackend("backup")
+	defer backup.Close()
+	catchAll := newBackend("catchall")
+	defer catchAll.Close()
+
+	config := Config{DefaultRouter: "catchall", BackendRouterConfigs: []BackendRouterConfig{
+		{Name: "primary", AcceptedPaths: []string{"/api"}, FallbackRouter: "backup", BackendConfigs: []BackendConfig{{Host: primary.URL, MaxConnections: 10}}},
+		{Name: "backup", BackendConfigs: []BackendConfig{{Host: backup.URL, MaxConnections: 10}}},
+		{Name: "catchall", BackendConfigs: []BackendConfig{{Host: catchAll.URL, MaxConnections: 10}}},
+	}}
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+
+	request := func(path string) int {
+		served = ""
+		res := httptest.NewRecorder()
+		lbl.handleRequestsAndRedirect(res, httptest.NewRequest(http.MethodGet, path, nil))
+		return res.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request("/api/x"))
+	assert.Equal(t, "primary", served)
+
+	assert.Equal(t, http.StatusOK, request("/other"))
+	assert.Equal(t, "catchall", served, "Expected default router for unmatched request")
+
+	router, _ := lbl.GetBackendRouterByName("primary")
+	be, _ := router.GetBackend()
+	be.SetIsAlive(false)
+	assert.Equal(t, http.StatusOK, request("/api/x"))
+	assert.Equal(t, "backup", served, "Expected fallback router when primary backends are dead")
+
+	router, _ = lbl.GetBackendRouterByName("backup")
+	be, _ = router.GetBackend()
+	be.SetIsAlive(false)
+	assert.Equal(t, http.StatusServiceUnavailable, request("/api/x"))
+	assert.Equal(t, "", served)
+}
+
+func TestRouterReferenceValidation(t *testing.T) {
+	config := generateTestConfig("/foo")
+	config.DefaultRouter = "missing"
+	assert.NotNil(t, config.Validate(), "Expected error for unknown DefaultRouter")
+
+	config = generateTestConfig("/foo")
+	config.BackendRouterConfigs[0].FallbackRouter = "missing"
+	assert.NotNil(t, config.Validate(), "Expected error for unknown FallbackRouter")
+
+	config = generateTestConfig("/foo")
+	config.BackendRouterConfigs = append(config.BackendRouterConfigs, BackendRouterConfig{Name: "spare"})
+	assert.NotNil(t, config.Validate(), "Expected error for router with nothing to route on")
+	config.BackendRouterConfigs[0].FallbackRouter = "spare"
+	assert.Nil(t, config.Validate(), "Expected fallback only router to be allowed")
+
+	config.BackendRouterConfigs[1].FallbackRouter = "/foo"
+	assert.NotNil(t, config.Validate(), "Expected error for fallback loop")
+
+	config.BackendRouterConfigs[1].FallbackRouter = "spare"
+	assert.NotNil(t, config.Validate(), "Expected error for router falling back to itself")
+}
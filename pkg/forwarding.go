@@ -0,0 +1,197 @@
+package pkg
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	xForwardedForHeader   string = "X-Forwarded-For"
+	xForwardedHostHeader  string = "X-Forwarded-Host"
+	xForwardedProtoHeader string = "X-Forwarded-Proto"
+	xForwardedPortHeader  string = "X-Forwarded-Port"
+	forwardedHeader       string = "Forwarded"
+)
+
+var forwardingHeaders = []string{xForwardedForHeader, xForwardedHostHeader, xForwardedProtoHeader, xForwardedPortHeader, forwardedHeader}
+
+// ForwardingConfig controls the headers that tell backends about the original client request.
+type ForwardingConfig struct {
+	// send X-Forwarded-For/Host/Proto/Port. Defaults to true.
+	XForwarded *bool `json:"xforwarded,omitempty"`
+
+	// send the RFC 7239 Forwarded header.
+	Forwarded bool `json:"forwarded,omitempty"`
+
+	// IPs or CIDRs of proxies in front of LBLight. Forwarding headers sent by these are kept and
+	// appended to, forwarding headers sent by anyone else are replaced.
+	TrustedProxies []string `json:"trustedproxies,omitempty"`
+}
+
+// Validate checks the forwarding config.
+func (c ForwardingConfig) Validate() error {
+	_, err := parseTrustedProxies(c.TrustedProxies)
+	return err
+}
+
+// forwarder sets the forwarding headers on requests going to backends.
+type forwarder struct {
+	xForwarded     bool
+	forwarded      bool
+	trustedProxies []*net.IPNet
+}
+
+// newForwarder creates a forwarder from config.
+func newForwarder(config ForwardingConfig) (*forwarder, error) {
+	trusted, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	f := forwarder{forwarded: config.Forwarded, trustedProxies: trusted}
+	f.xForwarded = config.XForwarded == nil || *config.XForwarded
+	return &f, nil
+}
+
+// parseTrustedProxies parses a list of IPs/CIDRs. Plain IPs are treated as a single address network.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy %s", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy %s : %s", proxy, err.Error())
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// isTrusted returns true if ip is one of the trusted proxies.
+func (f *forwarder) isTrusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range f.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setHeaders sets the forwarding headers on the outgoing request from in, what the client originally sent.
+// The headers are replaced rather than added to, as this runs again for each retry of the request.
+// X-Forwarded-For itself is added by the ReverseProxy (appending to what is already there), so this
+// only resets, removes or disables it as required.
+func (f *forwarder) setHeaders(req *http.Request, in inboundRequest) {
+	trusted := f.isTrusted(net.ParseIP(in.remoteIP))
+
+	// anything the client sent can't be believed, so start again. Trusted proxies' headers are kept.
+	for _, header := range forwardingHeaders {
+		req.Header.Del(header)
+		if values := in.forwardingHeaders[header]; trusted && len(values) > 0 {
+			req.Header[header] = append([]string(nil), values...)
+		}
+	}
+
+	if f.xForwarded {
+		setIfMissing(req.Header, xForwardedHostHeader, in.host)
+		setIfMissing(req.Header, xForwardedProtoHeader, in.proto)
+		setIfMissing(req.Header, xForwardedPortHeader, localPort(req, in.proto))
+	} else {
+		// nil stops the ReverseProxy adding X-Forwarded-For.
+		req.Header[xForwardedForHeader] = nil
+	}
+
+	if f.forwarded {
+		element := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(in.remoteIP), quoteForwarded(in.host), in.proto)
+		if existing := req.Header.Get(forwardedHeader); existing != "" {
+			element = existing + ", " + element
+		}
+		req.Header.Set(forwardedHeader, element)
+	}
+}
+
+// setIfMissing sets the header unless a (trusted) proxy already set it.
+func setIfMissing(header http.Header, key string, val string) {
+	if header.Get(key) == "" {
+		header.Set(key, val)
+	}
+}
+
+// localPort returns the port the client connected to.
+func localPort(req *http.Request, proto string) string {
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	if proto == "https" {
+		return strconv.Itoa(443)
+	}
+	return strconv.Itoa(80)
+}
+
+// forwardedNode formats an IP for the Forwarded header. IPv6 addresses must be bracketed and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return fmt.Sprintf("\"[%s]\"", ip)
+	}
+	return quoteForwarded(ip)
+}
+
+// quoteForwarded quotes the value if it isn't a valid RFC 7230 token (eg. has a port).
+func quoteForwarded(val string) string {
+	for _, c := range val {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return strconv.Quote(val)
+		}
+	}
+	return val
+}
+
+// clientIP returns the address of the original client. remoteIP is the peer's address; if it's a trusted
+// proxy then X-Forwarded-For is walked from the right, skipping further trusted proxies, and the first
+// untrusted address is the client.
+func (f *forwarder) clientIP(remoteIP string, xForwardedFor []string) string {
+	if !f.isTrusted(net.ParseIP(remoteIP)) {
+		return remoteIP
+	}
+
+	var hops []string
+	for _, val := range xForwardedFor {
+		for _, hop := range strings.Split(val, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	client := remoteIP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			break
+		}
+		client = hops[i]
+		if !f.isTrusted(ip) {
+			break
+		}
+	}
+	return client
+}
@@ -0,0 +1,132 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// newDroppingBackend starts a backend that drops the first connection without responding, so LBLight
+// retries the request. Every request the backend gets (including the dropped one) is returned by received.
+func newDroppingBackend(t *testing.T) (*httptest.Server, func() []*http.Request) {
+	var requests []*http.Request
+	var mux sync.Mutex
+	var dropped int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		requests = append(requests, r)
+		mux.Unlock()
+
+		if atomic.CompareAndSwapInt32(&dropped, 0, 1) {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			assert.Nil(t, err, "Error not expected")
+			conn.Close()
+		}
+	}))
+
+	received := func() []*http.Request {
+		mux.Lock()
+		defer mux.Unlock()
+		return append([]*http.Request(nil), requests...)
+	}
+	return backend, received
+}
+
+// forwardedRequest sends req through an LBLight configured with forwarding and preserveHost, and
+// returns the request the backend received.
+func forwardedRequest(t *testing.T, forwarding ForwardingConfig, preserveHost bool, req *http.Request) *http.Request {
+	var received *http.Request
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	}))
+	defer backend.Close()
+
+	config := generateTestConfig("/foo")
+	config.BackendRouterConfigs[0].BackendConfigs[0].Host = backend.URL
+	config.BackendRouterConfigs[0].PreserveHost = preserveHost
+	config.Forwarding = forwarding
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+
+	lbl.handleRequestsAndRedirect(httptest.NewRecorder(), req)
+	assert.NotNil(t, received, "Expected request at backend")
+	return received
+}
+
+func TestForwardingHeadersFromUntrustedClient(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Set("X-Forwarded-Host", "spoofed.com")
+	req.Header.Set("Forwarded", "for=1.2.3.4")
+
+	received := forwardedRequest(t, ForwardingConfig{Forwarded: true}, false, req)
+	assert.Equal(t, "192.0.2.1", received.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "example.com", received.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "http", received.Header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "80", received.Header.Get("X-Forwarded-Port"))
+	assert.Equal(t, "for=192.0.2.1;host=example.com;proto=http", received.Header.Get("Forwarded"))
+	assert.NotEqual(t, "example.com", received.Host)
+}
+
+func TestForwardingHeadersFromTrustedProxy(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("Forwarded", "for=1.2.3.4;proto=https")
+
+	received := forwardedRequest(t, ForwardingConfig{Forwarded: true, TrustedProxies: []string{"192.0.2.0/24"}}, true, req)
+	assert.Equal(t, "1.2.3.4, 192.0.2.1", received.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "https", received.Header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "for=1.2.3.4;proto=https, for=192.0.2.1;host=example.com;proto=http", received.Header.Get("Forwarded"))
+	assert.Equal(t, "example.com", received.Host)
+}
+
+func TestForwardingHeadersOnRetry(t *testing.T) {
+	backend, received := newDroppingBackend(t)
+	defer backend.Close()
+
+	config := generateTestConfig("/foo")
+	config.BackendRouterConfigs[0].BackendConfigs[0].Host = backend.URL
+	config.Forwarding = ForwardingConfig{Forwarded: true, TrustedProxies: []string{"192.0.2.0/24"}}
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+
+	req := httptest.NewRequest(http.MethodGet, "http://client.example/foo", nil)
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Set("Forwarded", "for=1.2.3.4")
+	res := httptest.NewRecorder()
+	lbl.handleRequestsAndRedirect(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	requests := received()
+	assert.Equal(t, 2, len(requests), "Expected the request to be retried")
+	for _, r := range requests {
+		assert.Equal(t, "client.example", r.Header.Get("X-Forwarded-Host"))
+		assert.Equal(t, "1.2.3.4, 192.0.2.1", r.Header.Get("X-Forwarded-For"))
+		assert.Equal(t, "for=1.2.3.4, for=192.0.2.1;host=client.example;proto=http", r.Header.Get("Forwarded"))
+	}
+}
+
+func TestForwardingHeadersDisabled(t *testing.T) {
+	disabled := false
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+	received := forwardedRequest(t, ForwardingConfig{XForwarded: &disabled}, false, req)
+	assert.Equal(t, "", received.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "", received.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "", received.Header.Get("Forwarded"))
+}
+
+func TestForwardingConfigValidation(t *testing.T) {
+	assert.Nil(t, ForwardingConfig{TrustedProxies: []string{"10.0.0.1", "10.1.0.0/16", "::1"}}.Validate(), "Error not expected")
+	assert.NotNil(t, ForwardingConfig{TrustedProxies: []string{"notanip"}}.Validate(), "Expected invalid proxy error")
+	assert.NotNil(t, ForwardingConfig{TrustedProxies: []string{"10.0.0.0/99"}}.Validate(), "Expected invalid proxy error")
+	assert.Equal(t, `"[::1]"`, forwardedNode("::1"))
+	assert.Equal(t, `"example.com:8080"`, quoteForwarded("example.com:8080"))
+}
@@ -0,0 +1,204 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	HeaderActionAdd    string = "add"
+	HeaderActionSet    string = "set"
+	HeaderActionRemove string = "remove"
+	HeaderActionRename string = "rename"
+)
+
+// headerPlaceholders are the values that can be used in header rule values, as {name}.
+var headerPlaceholders = map[string]func(req *http.Request, info *requestInfo) string{
+	"client_ip":  func(req *http.Request, info *requestInfo) string { return info.clientIP(req) },
+	"request_id": func(req *http.Request, info *requestInfo) string { return info.requestID },
+	"router":     func(req *http.Request, info *requestInfo) string { return info.routerName() },
+	"backend": func(req *http.Request, info *requestInfo) string {
+		if info.backend == nil {
+			return ""
+		}
+		return info.backend.Host
+	},
+	"method": func(req *http.Request, info *requestInfo) string { return req.Method },
+	"path":   func(req *http.Request, info *requestInfo) string { return req.URL.Path },
+}
+
+// HeaderRulesConfig lists the changes made to request headers before they go to the backend, and to
+// response headers before they go back to the client. Rules are applied in order.
+type HeaderRulesConfig struct {
+	Request  []HeaderRule `json:"request,omitempty"`
+	Response []HeaderRule `json:"response,omitempty"`
+}
+
+// HeaderRule is a single change to a header.
+type HeaderRule struct {
+	// add (another value), set (replacing any values), remove or rename.
+	Action string `json:"action"`
+	Name   string `json:"name"`
+
+	// for add and set. Can include {client_ip}, {request_id}, {router}, {backend}, {method} and {path}
+	// (as sent to the backend).
+	Value string `json:"value,omitempty"`
+
+	// new name, for rename.
+	To string `json:"to,omitempty"`
+}
+
+// Validate checks the header rules.
+func (c HeaderRulesConfig) Validate() error {
+	_, err := newHeaderRules(c)
+	return err
+}
+
+// headerRules are the compiled rules for a router.
+type headerRules struct {
+	request  []headerRule
+	response []headerRule
+}
+
+type headerRule struct {
+	action string
+	name   string
+	to     string
+	value  headerTemplate
+}
+
+// headerTemplate is a value split into literal text and placeholders, so it's only parsed once.
+type headerTemplate []headerTemplatePart
+
+type headerTemplatePart struct {
+	literal     string
+	placeholder func(req *http.Request, info *requestInfo) string
+}
+
+// newHeaderRules compiles config. Returns nil if there are no rules.
+func newHeaderRules(config HeaderRulesConfig) (*headerRules, error) {
+	if len(config.Request) == 0 && len(config.Response) == 0 {
+		return nil, nil
+	}
+
+	request, err := compileHeaderRules(config.Request, "request")
+	if err != nil {
+		return nil, err
+	}
+	response, err := compileHeaderRules(config.Response, "response")
+	if err != nil {
+		return nil, err
+	}
+	return &headerRules{request: request, response: response}, nil
+}
+
+func compileHeaderRules(rules []HeaderRule, kind string) ([]headerRule, error) {
+	var compiled []headerRule
+	for _, rule := range rules {
+		hr := headerRule{action: strings.ToLower(rule.Action), name: http.CanonicalHeaderKey(rule.Name), to: http.CanonicalHeaderKey(rule.To)}
+		if hr.name == "" {
+			return nil, fmt.Errorf("%s header rule has no name", kind)
+		}
+
+		// Host isn't a header as far as net/http is concerned, see PreserveHost.
+		if hr.name == "Host" || hr.to == "Host" {
+			return nil, fmt.Errorf("%s header rule can't change the Host header", kind)
+		}
+
+		switch hr.action {
+		case HeaderActionAdd, HeaderActionSet:
+			value, err := parseHeaderTemplate(rule.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%s header rule for %s : %s", kind, rule.Name, err.Error())
+			}
+			hr.value = value
+		case HeaderActionRemove:
+		case HeaderActionRename:
+			if hr.to == "" {
+				return nil, fmt.Errorf("%s header rule renaming %s has no to", kind, rule.Name)
+			}
+		default:
+			return nil, fmt.Errorf("%s header rule for %s has unknown action %s", kind, rule.Name, rule.Action)
+		}
+		compiled = append(compiled, hr)
+	}
+	return compiled, nil
+}
+
+// parseHeaderTemplate splits value into literals and {placeholders}. Braces that aren't a known placeholder
+// are an error, so typos are found when the config is loaded.
+func parseHeaderTemplate(value string) (headerTemplate, error) {
+	var template headerTemplate
+	for value != "" {
+		start := strings.Index(value, "{")
+		if start == -1 {
+			template = append(template, headerTemplatePart{literal: value})
+			break
+		}
+		end := strings.Index(value[start:], "}")
+		if end == -1 {
+			return nil, fmt.Errorf("unclosed { in %s", value)
+		}
+
+		name := value[start+1 : start+end]
+		placeholder, ok := headerPlaceholders[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown placeholder {%s}", name)
+		}
+		if start > 0 {
+			template = append(template, headerTemplatePart{literal: value[:start]})
+		}
+		template = append(template, headerTemplatePart{placeholder: placeholder})
+		value = value[start+end+1:]
+	}
+	return template, nil
+}
+
+// expand fills in the placeholders for the request.
+func (ht headerTemplate) expand(req *http.Request, info *requestInfo) string {
+	var sb strings.Builder
+	for _, part := range ht {
+		if part.placeholder != nil {
+			if info != nil {
+				sb.WriteString(part.placeholder(req, info))
+			}
+			continue
+		}
+		sb.WriteString(part.literal)
+	}
+	return sb.String()
+}
+
+// applyHeaderRules makes the changes to header. req is the request the placeholders are taken from.
+func applyHeaderRules(rules []headerRule, header http.Header, req *http.Request, info *requestInfo) {
+	for _, rule := range rules {
+		switch rule.action {
+		case HeaderActionAdd:
+			header.Add(rule.name, rule.value.expand(req, info))
+		case HeaderActionSet:
+			header.Set(rule.name, rule.value.expand(req, info))
+		case HeaderActionRemove:
+			header.Del(rule.name)
+		case HeaderActionRename:
+			values := header.Values(rule.name)
+			if len(values) == 0 {
+				continue
+			}
+			header.Del(rule.name)
+			for _, val := range values {
+				header.Add(rule.to, val)
+			}
+		}
+	}
+}
+
+// modifyRequest applies the router's request rules to the request going to the backend.
+func (hr *headerRules) modifyRequest(req *http.Request, info *requestInfo) {
+	applyHeaderRules(hr.request, req.Header, req, info)
+}
+
+// modifyResponse applies the router's response rules to the backend's response.
+func (hr *headerRules) modifyResponse(resp *http.Response, info *requestInfo) {
+	applyHeaderRules(hr.response, resp.Header, resp.Request, info)
+}
@@ -0,0 +1,119 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeaderRules(t *testing.T) {
+	var received *http.Request
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		w.Header().Set("Server", "backend/1.0")
+		w.Header().Set("X-Internal", "secret")
+		w.Header().Add("X-Old", "a")
+		w.Header().Add("X-Old", "b")
+	}))
+	defer backend.Close()
+
+	config := generateTestConfig("/foo")
+	config.BackendRouterConfigs[0].BackendConfigs[0].Host = backend.URL
+	config.BackendRouterConfigs[0].Headers = HeaderRulesConfig{
+		Request: []HeaderRule{
+			{Action: "set", Name: "X-Client", Value: "ip={client_ip} id={request_id}"},
+			{Action: "add", Name: "X-Route", Value: "{router} {method} {path}"},
+			{Action: "remove", Name: "Cookie"},
+			{Action: "rename", Name: "X-Api-Key", To: "X-Backend-Key"},
+			{Action: "set", Name: "X-Forwarded-Proto", Value: "https"},
+		},
+		Response: []HeaderRule{
+			{Action: "remove", Name: "server"},
+			{Action: "remove", Name: "X-Internal"},
+			{Action: "rename", Name: "X-Old", To: "X-New"},
+			{Action: "set", Name: "X-Served-By", Value: "{backend}"},
+		},
+	}
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+
+	req := httptest.NewRequest(http.MethodGet, "/foo/bar", nil)
+	req.Header.Set(RequestIDHeader, "abc")
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-API-Key", "key1")
+	res := httptest.NewRecorder()
+	lbl.handleRequestsAndRedirect(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	assert.Equal(t, "ip=192.0.2.1 id=abc", received.Header.Get("X-Client"))
+	assert.Equal(t, "/foo GET /foo/bar", received.Header.Get("X-Route"))
+	assert.Equal(t, "", received.Header.Get("Cookie"))
+	assert.Equal(t, "", received.Header.Get("X-API-Key"))
+	assert.Equal(t, "key1", received.Header.Get("X-Backend-Key"))
+	assert.Equal(t, "https", received.Header.Get("X-Forwarded-Proto"), "Expected rule to override forwarding header")
+
+	assert.Equal(t, "", res.Header().Get("Server"))
+	assert.Equal(t, "", res.Header().Get("X-Internal"))
+	assert.Equal(t, []string{"a", "b"}, res.Header().Values("X-New"))
+	assert.Equal(t, backend.URL, res.Header().Get("X-Served-By"))
+	assert.Equal(t, "abc", res.Header().Get(RequestIDHeader))
+}
+
+func TestHeaderRulesOnRetry(t *testing.T) {
+	backend, received := newDroppingBackend(t)
+	defer backend.Close()
+
+	config := generateTestConfig("/foo")
+	config.BackendRouterConfigs[0].BackendConfigs[0].Host = backend.URL
+	config.BackendRouterConfigs[0].Headers = HeaderRulesConfig{Request: []HeaderRule{
+		{Action: "add", Name: "X-Route", Value: "{router}"},
+		{Action: "rename", Name: "X-Api-Key", To: "X-Backend-Key"},
+	}}
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.Header.Set("X-Api-Key", "key1")
+	res := httptest.NewRecorder()
+	lbl.handleRequestsAndRedirect(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	requests := received()
+	assert.Equal(t, 2, len(requests), "Expected the request to be retried")
+	for _, r := range requests {
+		assert.Equal(t, []string{"/foo"}, r.Header.Values("X-Route"), "Expected added header once")
+		assert.Equal(t, []string{"key1"}, r.Header.Values("X-Backend-Key"))
+		assert.Equal(t, "", r.Header.Get("X-Api-Key"))
+	}
+}
+
+func TestHeaderRulesValidation(t *testing.T) {
+	valid := HeaderRulesConfig{Request: []HeaderRule{{Action: "SET", Name: "X-A", Value: "{client_ip}-{router}"}}}
+	assert.Nil(t, valid.Validate(), "Error not expected")
+
+	invalid := []HeaderRulesConfig{
+		{Request: []HeaderRule{{Action: "set", Name: "X-A", Value: "{clientip}"}}},
+		{Request: []HeaderRule{{Action: "set", Name: "X-A", Value: "{client_ip"}}},
+		{Request: []HeaderRule{{Action: "replace", Name: "X-A"}}},
+		{Request: []HeaderRule{{Action: "rename", Name: "X-A"}}},
+		{Request: []HeaderRule{{Action: "set", Name: "Host", Value: "example.com"}}},
+		{Response: []HeaderRule{{Action: "remove"}}},
+	}
+	for _, config := range invalid {
+		assert.NotNil(t, config.Validate(), "Expected error for %v", config)
+	}
+}
+
+func TestParseHeaderTemplate(t *testing.T) {
+	template, err := parseHeaderTemplate("a {method} b {path}")
+	assert.Nil(t, err, "Error not expected")
+	req := httptest.NewRequest(http.MethodPut, "/x", nil)
+	assert.Equal(t, "a PUT b /x", template.expand(req, &requestInfo{}))
+
+	template, err = parseHeaderTemplate("")
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, "", template.expand(req, &requestInfo{}))
+}
@@ -0,0 +1,227 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HealthStatusOK       string = "ok"
+	HealthStatusNotReady string = "not ready"
+)
+
+// healthPaths are the paths on the traffic listener that LBLight answers itself.
+type healthPaths struct {
+	liveness  string
+	readiness string
+}
+
+// configStatus records how the last config load went.
+type configStatus struct {
+	loadedAt    time.Time
+	lastError   string
+	lastErrorAt time.Time
+	mux         sync.RWMutex
+}
+
+// ConfigStatus reports when the config was last loaded, and the last error if the most recent load failed.
+type ConfigStatus struct {
+	Loaded      bool       `json:"loaded"`
+	LoadedAt    *time.Time `json:"loadedat,omitempty"`
+	LastError   string     `json:"lasterror,omitempty"`
+	LastErrorAt *time.Time `json:"lasterrorat,omitempty"`
+}
+
+// ListenerStatus reports the state of the traffic listener.
+type ListenerStatus struct {
+	Address   string `json:"address"`
+	Listening bool   `json:"listening"`
+	Draining  bool   `json:"draining"`
+}
+
+// RouterHealth reports how many backends of a router are alive, and how many of those are available for
+// new requests (active and weighted, not draining or disabled).
+type RouterHealth struct {
+	Name              string `json:"name"`
+	AliveBackends     int    `json:"alivebackends"`
+	AvailableBackends int    `json:"availablebackends"`
+	TotalBackends     int    `json:"totalbackends"`
+	FallbackRouter    string `json:"fallbackrouter,omitempty"`
+}
+
+// HealthStatus is the body of the /healthz and /readyz responses.
+type HealthStatus struct {
+	Status   string         `json:"status"`
+	Reasons  []string       `json:"reasons,omitempty"`
+	Config   ConfigStatus   `json:"config"`
+	Listener ListenerStatus `json:"listener"`
+	Routers  []RouterHealth `json:"routers"`
+}
+
+// record notes the result of a config load. A failed load leaves the previous config in use.
+func (cs *configStatus) record(err error) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	if err != nil {
+		cs.lastError = err.Error()
+		cs.lastErrorAt = time.Now()
+		return
+	}
+	cs.loadedAt = time.Now()
+	cs.lastError = ""
+	cs.lastErrorAt = time.Time{}
+}
+
+func (cs *configStatus) getStatus() ConfigStatus {
+	cs.mux.RLock()
+	defer cs.mux.RUnlock()
+
+	status := ConfigStatus{Loaded: !cs.loadedAt.IsZero(), LastError: cs.lastError}
+	if status.Loaded {
+		loadedAt := cs.loadedAt
+		status.LoadedAt = &loadedAt
+	}
+	if cs.lastError != "" {
+		lastErrorAt := cs.lastErrorAt
+		status.LastErrorAt = &lastErrorAt
+	}
+	return status
+}
+
+// RecordConfigError notes that the config file couldn't be loaded (eg. a parse error on reload), so it shows
+// up in the health status. Errors from Reload are recorded automatically.
+func (l *LBLight) RecordConfigError(err error) {
+	l.configStatus.record(err)
+}
+
+// Liveness returns the health of LBLight itself. LBLight is live as long as it can answer, the status
+// is for information.
+func (l *LBLight) Liveness() HealthStatus {
+	status := l.healthStatus()
+	status.Status = HealthStatusOK
+	return status
+}
+
+// Readiness returns whether LBLight can take traffic: it has loaded a config, is listening and not shutting
+// down, and every router has a backend available for new requests (itself or through its fallback routers).
+func (l *LBLight) Readiness() (HealthStatus, bool) {
+	status := l.healthStatus()
+	if !status.Config.Loaded {
+		status.Reasons = append(status.Reasons, "no config loaded")
+	}
+	if !status.Listener.Listening {
+		status.Reasons = append(status.Reasons, "not listening")
+	}
+	if status.Listener.Draining {
+		status.Reasons = append(status.Reasons, "shutting down")
+	}
+	routers := make(map[string]RouterHealth)
+	for _, router := range status.Routers {
+		routers[router.Name] = router
+	}
+	for _, router := range status.Routers {
+		if !routerCanServe(routers, router) {
+			status.Reasons = append(status.Reasons, fmt.Sprintf("router %s has no available backends", router.Name))
+		}
+	}
+
+	if len(status.Reasons) > 0 {
+		status.Status = HealthStatusNotReady
+		return status, false
+	}
+	status.Status = HealthStatusOK
+	return status, true
+}
+
+func (l *LBLight) healthStatus() HealthStatus {
+	status := HealthStatus{Config: l.configStatus.getStatus(), Routers: []RouterHealth{}}
+	status.Listener = ListenerStatus{Address: l.listenAddr, Listening: atomic.LoadInt32(&l.serving) == 1, Draining: l.IsDraining()}
+
+	for _, ber := range l.getRoutingTable().allBackendRouters {
+		router := RouterHealth{Name: ber.Name}
+		if ber.fallback != nil {
+			router.FallbackRouter = ber.fallback.Name
+		}
+		for _, be := range ber.getBackends() {
+			router.TotalBackends++
+			if be.IsAlive() {
+				router.AliveBackends++
+			}
+			if be.isSelectable() {
+				router.AvailableBackends++
+			}
+		}
+		status.Routers = append(status.Routers, router)
+	}
+	return status
+}
+
+// routerCanServe returns true if router, or a router it falls back to, has a backend available for new requests.
+func routerCanServe(routers map[string]RouterHealth, router RouterHealth) bool {
+	visited := make(map[string]bool)
+	for {
+		if router.AvailableBackends > 0 {
+			return true
+		}
+
+		// config validation stops loops, but don't rely on it.
+		visited[router.Name] = true
+		next, ok := routers[router.FallbackRouter]
+		if !ok || visited[next.Name] {
+			return false
+		}
+		router = next
+	}
+}
+
+// HealthzHandler serves the liveness status, always 200.
+func (l *LBLight) HealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, l.Liveness())
+	})
+}
+
+// ReadyzHandler serves the readiness status, 200 if ready otherwise 503.
+func (l *LBLight) ReadyzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, ready := l.Readiness()
+		if !ready {
+			writeHealth(w, http.StatusServiceUnavailable, status)
+			return
+		}
+		writeHealth(w, http.StatusOK, status)
+	})
+}
+
+// serveHealth answers the request if it's for the liveness/readiness path configured on the traffic
+// listener. Returns true if it did.
+func (l *LBLight) serveHealth(res http.ResponseWriter, req *http.Request) bool {
+	l.routesMux.RLock()
+	paths := l.healthPaths
+	l.routesMux.RUnlock()
+
+	switch {
+	case paths.liveness != "" && req.URL.Path == paths.liveness:
+		l.HealthzHandler().ServeHTTP(res, req)
+	case paths.readiness != "" && req.URL.Path == paths.readiness:
+		l.ReadyzHandler().ServeHTTP(res, req)
+	default:
+		return false
+	}
+	return true
+}
+
+func writeHealth(w http.ResponseWriter, statusCode int, status HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		log.Errorf("Unable to write health response: %s", err.Error())
+	}
+}
@@ -0,0 +1,140 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func getHealth(t *testing.T, handler http.Handler, path string) (int, HealthStatus) {
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+
+	var status HealthStatus
+	err := json.NewDecoder(res.Body).Decode(&status)
+	assert.Nil(t, err, "Error not expected")
+	return res.Code, status
+}
+
+func TestReadiness(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lbl := generateTestLBLight(t, backend.URL)
+	code, status := getHealth(t, lbl.ReadyzHandler(), "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, []string{"not listening"}, status.Reasons)
+
+	_, serveErr := startTestTraffic(t, lbl)
+	code, status = getHealth(t, lbl.ReadyzHandler(), "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, HealthStatusOK, status.Status)
+	assert.True(t, status.Config.Loaded)
+	assert.Equal(t, []RouterHealth{{Name: "/foo", AliveBackends: 1, AvailableBackends: 1, TotalBackends: 1}}, status.Routers)
+
+	ber, _ := lbl.GetBackendRouterByName("/foo")
+	be, _ := ber.GetBackendByHost(backend.URL)
+	be.SetIsAlive(false)
+	code, status = getHealth(t, lbl.ReadyzHandler(), "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, []string{"router /foo has no available backends"}, status.Reasons)
+	be.SetIsAlive(true)
+
+	// alive, but not taking new requests.
+	be.SetState(BackendDraining)
+	code, status = getHealth(t, lbl.ReadyzHandler(), "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, []string{"router /foo has no available backends"}, status.Reasons)
+	assert.Equal(t, []RouterHealth{{Name: "/foo", AliveBackends: 1, TotalBackends: 1}}, status.Routers)
+	be.SetState(BackendActive)
+
+	lbl.StartDraining()
+	code, status = getHealth(t, lbl.ReadyzHandler(), "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, []string{"shutting down"}, status.Reasons)
+
+	// still live while shutting down.
+	code, status = getHealth(t, lbl.HealthzHandler(), "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, status.Listener.Draining)
+
+	lbl.Shutdown(context.Background())
+	assert.Nil(t, <-serveErr, "Error not expected")
+}
+
+func TestReadinessUsesFallbackRouters(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	config := Config{BackendRouterConfigs: []BackendRouterConfig{
+		{Name: "primary", AcceptedPaths: []string{"/api"}, FallbackRouter: "backup", BackendConfigs: []BackendConfig{{Host: "http://10.0.0.1:5000", MaxConnections: 10}}},
+		{Name: "backup", AcceptedPaths: []string{"/backup"}, BackendConfigs: []BackendConfig{{Host: backend.URL, MaxConnections: 10}}},
+	}}
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+	_, serveErr := startTestTraffic(t, lbl)
+	defer func() {
+		lbl.Shutdown(context.Background())
+		<-serveErr
+	}()
+
+	primary, _ := lbl.GetBackendRouterByName("primary")
+	primaryBackend, _ := primary.GetBackendByHost("http://10.0.0.1:5000")
+	primaryBackend.SetState(BackendDisabled)
+	code, status := getHealth(t, lbl.ReadyzHandler(), "/readyz")
+	assert.Equal(t, http.StatusOK, code, "Expected ready when the fallback router can serve")
+	assert.Empty(t, status.Reasons)
+
+	backup, _ := lbl.GetBackendRouterByName("backup")
+	backupBackend, _ := backup.GetBackendByHost(backend.URL)
+	backupBackend.SetIsAlive(false)
+	code, status = getHealth(t, lbl.ReadyzHandler(), "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, []string{"router primary has no available backends", "router backup has no available backends"}, status.Reasons)
+}
+
+func TestHealthRecordsConfigErrors(t *testing.T) {
+	lbl := NewLBLight(4000, false)
+	_, status := getHealth(t, lbl.HealthzHandler(), "/healthz")
+	assert.False(t, status.Config.Loaded)
+
+	err := lbl.Reload(generateTestConfig("/foo"))
+	assert.Nil(t, err, "Error not expected")
+	lbl.RecordConfigError(fmt.Errorf("Unable to parse config"))
+
+	code, status := getHealth(t, lbl.HealthzHandler(), "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, status.Config.Loaded, "Previous config still in use")
+	assert.Equal(t, "Unable to parse config", status.Config.LastError)
+
+	// a good reload clears the error.
+	err = lbl.Reload(generateTestConfig("/foo"))
+	assert.Nil(t, err, "Error not expected")
+	_, status = getHealth(t, lbl.HealthzHandler(), "/healthz")
+	assert.Equal(t, "", status.Config.LastError)
+}
+
+func TestHealthOnTrafficAndAdminPorts(t *testing.T) {
+	config := generateTestConfig("/")
+	config.LivenessPath = "/_lblight/live"
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+
+	// answered by LBLight, not proxied to the (non existent) backend.
+	code, status := getHealth(t, http.HandlerFunc(lbl.handleRequestsAndRedirect), "/_lblight/live")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, HealthStatusOK, status.Status)
+
+	// no token needed on the admin port.
+	admin := NewAdminServer(lbl, 9000, "secret")
+	code, _ = getHealth(t, admin, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	code, _ = getHealth(t, admin, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+}
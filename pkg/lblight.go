@@ -1,11 +1,16 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // LBLight is the core of the load balancer.
@@ -14,70 +19,160 @@ import (
 type LBLight struct {
 	port int
 
-	// match prefix to appropriate router
-	pathPrefixToBackendRouter map[string]*BackendRouter
+	// address to listen on, defaults to all interfaces on port.
+	listenAddr string
 
-	// match header KEY to a potential router
-	headerToBackendRouter map[string]map[string]*BackendRouter
+	// paths/headers to BackendRouters. Swapped out wholesale on reload, never modified in place.
+	routes    *routingTable
+	routesMux sync.RWMutex
 
-	// all BackendRouters.... just single point of reference for stats gathering.
-	allBackendRouters []*BackendRouter
+	// sets the X-Forwarded-*/Forwarded headers. Replaced on reload, protected by routesMux.
+	forwarding *forwarder
+
+	// shared store for rate limits, nil if limits are local. Replaced on reload, protected by routesMux.
+	rateLimitStore *rateLimitStore
+
+	// longest URL accepted, 0 for no limit. Replaced on reload, protected by routesMux.
+	maxURLLength int
+
+	// response when no router matches. Replaced on reload, protected by routesMux.
+	notFound NotFoundConfig
+
+	// pages for errors, nil if none configured. Replaced on reload, protected by routesMux.
+	errorPages *errorPages
+
+	// paths on the traffic listener answered by LBLight itself. Replaced on reload, protected by routesMux.
+	healthPaths healthPaths
+
+	// result of the last config load/reload.
+	configStatus configStatus
 
 	// listen for TLS traffic (not behind TLS endpoint)
 	tlsListener bool
 
 	// just used to lock when we're gathering stats.
 	statsMux sync.RWMutex
+
+	metrics *metrics
+
+	// nil if no access log configured.
+	accessLog *AccessLogger
+
+	// creates spans for each request. noop unless SetTracerProvider called.
+	tracer trace.Tracer
+
+	// max size of request headers, 0 for the net/http default.
+	maxHeaderBytes int
+
+	// sources allowed to send a PROXY protocol header. nil if PROXY protocol is not accepted.
+	proxyProtocolTrusted []*net.IPNet
+
+	// traffic listener and server, set by ListenAndServeTraffic. draining is set (atomically) once Shutdown is called,
+	// serving while the server is accepting connections.
+	listener  net.Listener
+	server    *http.Server
+	serverMux sync.Mutex
+	draining  int32
+	serving   int32
+
+	// number of client requests currently being handled.
+	inFlight int64
 }
 
 func NewLBLight(port int, tlsListener bool) *LBLight {
 	lbl := LBLight{}
-	lbl.pathPrefixToBackendRouter = make(map[string]*BackendRouter)
-	lbl.headerToBackendRouter = make(map[string]map[string]*BackendRouter)
+	lbl.routes = newRoutingTable()
+	lbl.forwarding, _ = newForwarder(ForwardingConfig{})
 	lbl.tlsListener = tlsListener
 	lbl.port = port
+	lbl.listenAddr = fmt.Sprintf(":%d", port)
+	lbl.metrics = newMetrics(&lbl)
+	lbl.tracer = trace.NewNoopTracerProvider().Tracer(tracerName)
 	return &lbl
 }
 
-// GetBackendRouterByExactPathPrefix returns the backend router which is registered for the exact
-// match of "path". This is more for registration.
-func (l *LBLight) GetBackendRouterByExactPathPrefix(path string) (*BackendRouter, error) {
+// SetListenAddress overrides the address (host:port) LBLight listens on. Must be called before
+// ListenAndServeTraffic.
+func (l *LBLight) SetListenAddress(addr string) {
+	l.listenAddr = addr
+}
 
-	lowerPath := strings.ToLower(path)
-	backend, ok := l.pathPrefixToBackendRouter[lowerPath]
-	if ok {
-		return backend, nil
+// SetAccessLogger sets where the per request access log is written. nil disables it.
+// Must be called before ListenAndServeTraffic.
+func (l *LBLight) SetAccessLogger(al *AccessLogger) {
+	l.accessLog = al
+}
+
+// SetProxyProtocol enables accepting PROXY protocol headers on the traffic listener.
+// Must be called before ListenAndServeTraffic.
+func (l *LBLight) SetProxyProtocol(config ProxyProtocolConfig) error {
+	err := config.Validate()
+	if err != nil {
+		return err
 	}
+	if !config.Enabled {
+		l.proxyProtocolTrusted = nil
+		return nil
+	}
+
+	l.proxyProtocolTrusted, err = parseTrustedProxies(config.TrustedCIDRs)
+	return err
+}
+
+// SetTracerProvider sets the provider used to create spans for each request.
+// Must be called before ListenAndServeTraffic.
+func (l *LBLight) SetTracerProvider(tp trace.TracerProvider) {
+	l.tracer = tp.Tracer(tracerName)
+}
+
+// getForwarder returns the current forwarder.
+func (l *LBLight) getForwarder() *forwarder {
+	l.routesMux.RLock()
+	defer l.routesMux.RUnlock()
+	return l.forwarding
+}
+
+// getErrorPages returns the global error pages, nil if there aren't any.
+func (l *LBLight) getErrorPages() *errorPages {
+	l.routesMux.RLock()
+	defer l.routesMux.RUnlock()
+	return l.errorPages
+}
 
-	return nil, fmt.Errorf("Unable to find matching backend for path %s", path)
+// getRoutingTable returns the current routing table. Callers should grab this once per request
+// and use it throughout, so a reload midway through doesn't give a mix of old and new routes.
+func (l *LBLight) getRoutingTable() *routingTable {
+	l.routesMux.RLock()
+	defer l.routesMux.RUnlock()
+	return l.routes
+}
+
+// GetBackendRouterByExactPathPrefix returns the backend router which is registered for the exact
+// match of "path". This is more for registration.
+func (l *LBLight) GetBackendRouterByExactPathPrefix(path string) (*BackendRouter, error) {
+	return l.getRoutingTable().getBackendRouterByExactPathPrefix(path)
 }
 
 // GetBackendRouterByPathPrefix Checks all routers that have been registered for path prefixes and
 // searches each registered BackendRouter for a prefix match. This means it's NOT just a map lookup
 // but iterating over all of them looking for prefix matches. May need to rethink this a bit.
 func (l *LBLight) GetBackendRouterByPathPrefix(path string) (*BackendRouter, error) {
-	lowerPath := strings.ToLower(path)
-	for prefix, router := range l.pathPrefixToBackendRouter {
-		if strings.HasPrefix(lowerPath, prefix) {
-			return router, nil
-		}
-	}
-
-	return nil, fmt.Errorf("Unable to find matching backend for path %s", path)
+	return l.getRoutingTable().getBackendRouterByPathPrefix(path)
 }
 
-func (l *LBLight) GetBackendRouterByHeader(headerName string, headerValue string) (*BackendRouter, error) {
+// GetBackendRouterByHostAndPath returns the router for a request to host (which may include a port) and
+// path. Routers for the host are preferred over routers for any host, and longer path prefixes over shorter.
+func (l *LBLight) GetBackendRouterByHostAndPath(host string, path string) (*BackendRouter, error) {
+	return l.getRoutingTable().getBackendRouterByHostAndPath(host, path)
+}
 
-	headerValues, ok := l.headerToBackendRouter[headerName]
-	if ok {
-		// have a match for header... now check specific value.
-		headerNameAndValueBackend, ok2 := headerValues[headerValue]
-		if ok2 {
-			return headerNameAndValueBackend, nil
-		}
-	}
+// GetBackendRouterByName returns the BackendRouter with the given name.
+func (l *LBLight) GetBackendRouterByName(name string) (*BackendRouter, error) {
+	return l.getRoutingTable().getBackendRouterByName(name)
+}
 
-	return nil, fmt.Errorf("Unable to find matching backend for header %s : %s", headerName, headerValue)
+func (l *LBLight) GetBackendRouterByHeader(headerName string, headerValue string) (*BackendRouter, error) {
+	return l.getRoutingTable().getBackendRouterByHeader(headerName, headerValue)
 }
 
 // checkHealthOfAllBackendRouters loops through all BackendRouters, in turn
@@ -85,14 +180,12 @@ func (l *LBLight) GetBackendRouterByHeader(headerName string, headerValue string
 // health.
 func (l *LBLight) CheckHealthOfAllBackendRouters() error {
 
-	if l.allBackendRouters != nil {
-		for _, ber := range l.allBackendRouters {
+	for _, ber := range l.getRoutingTable().allBackendRouters {
 
-			// ignoring error return value.
-			// The error will be indicating if the backend is healthy or not, and the Backend itself
-			// should be logging if its not healthy. Would just be doubling up on logging here.
-			ber.checkHealthOfAllBackends()
-		}
+		// ignoring error return value.
+		// The error will be indicating if the backend is healthy or not, and the Backend itself
+		// should be logging if its not healthy. Would just be doubling up on logging here.
+		ber.checkHealthOfAllBackends()
 	}
 	return nil
 }
@@ -101,128 +194,420 @@ func (l *LBLight) CheckHealthOfAllBackendRouters() error {
 // at runtime. If we have multiple, then we'd definitely NOT know who the request
 // really should go to. If any of the paths/headers fail for thie BER, then fail them all.
 func (l *LBLight) AddBackendRouter(ber *BackendRouter) error {
+	l.routesMux.Lock()
+	defer l.routesMux.Unlock()
 
-	// list of all backend routers... just for stats.
-	l.allBackendRouters = append(l.allBackendRouters, ber)
+	newRoutes := l.routes.clone()
+	if err := newRoutes.addBackendRouter(ber); err != nil {
+		return err
+	}
+	l.routes = newRoutes
+	return nil
+}
 
-	// check if path/header already registered.
-	if ber.acceptedPaths != nil {
-		for path, _ := range ber.acceptedPaths {
-			_, err := l.GetBackendRouterByExactPathPrefix(path)
-			if err == nil {
-				// no error, we already have something registered!
-				return fmt.Errorf("Conflict: Backend path %s already registered", path)
-			}
-		}
+// Reload builds a brand new routing table from config and swaps it in place of the current one.
+// Requests already in flight keep using the Backends they were given. Backends that exist in both
+// the old and new config (same router name, host and port) are carried across so they keep
+// their BackendConnection pools and health state.
+func (l *LBLight) Reload(config Config) error {
+	err := l.reload(config)
+	l.configStatus.record(err)
+	return err
+}
+
+func (l *LBLight) reload(config Config) error {
+
+	err := config.Validate()
+	if err != nil {
+		return err
 	}
 
-	// check headers.
-	if ber.acceptedHeaders != nil {
-		for header, val := range ber.acceptedHeaders {
-			_, err2 := l.GetBackendRouterByHeader(header, val)
-			if err2 == nil {
-				// no error, we already have something registered!
-				return fmt.Errorf("Conflict: Backend header %s : %s already registered", header, val)
-			}
-		}
+	// only one reload at a time, otherwise two reloads could both build from the same old table.
+	l.routesMux.Lock()
+	defer l.routesMux.Unlock()
+
+	forwarding, err := newForwarder(config.Forwarding)
+	if err != nil {
+		return err
 	}
 
-	// register valid paths/headers
-	if ber.acceptedPaths != nil {
-		for path, _ := range ber.acceptedPaths {
-			l.pathPrefixToBackendRouter[path] = ber
-		}
+	errorPages, err := newErrorPages(config.ErrorPages)
+	if err != nil {
+		return err
 	}
 
-	if ber.acceptedHeaders != nil {
-		for header, val := range ber.acceptedHeaders {
-			//l.headerToBackendRouter[header][val] = ber
-			var specificHeaderMap map[string]*BackendRouter
-			var ok bool
-			specificHeaderMap, ok = l.headerToBackendRouter[header]
-			if !ok {
-				//headerVal, ok2 := specificHeaderMap[val]
-				specificHeaderMap = make(map[string]*BackendRouter)
-			}
-			specificHeaderMap[val] = ber
+	store := getRateLimitStore(config.RateLimitStore, l.rateLimitStore)
+	newRoutes, err := buildRoutingTable(config, l.routes, store)
+	if err != nil {
+		if store != nil && store != l.rateLimitStore {
+			store.Close()
 		}
+		return err
+	}
+
+	// requests still using the old limiters fall back to local limits once it's closed.
+	if l.rateLimitStore != nil && l.rateLimitStore != store {
+		l.rateLimitStore.Close()
 	}
 
+	closeRemovedBackends(l.routes, newRoutes)
+	l.routes = newRoutes
+	l.rateLimitStore = store
+	l.forwarding = forwarding
+	l.maxURLLength = config.MaxURLLength
+	l.notFound = config.NotFound
+	l.errorPages = errorPages
+	l.healthPaths = healthPaths{liveness: config.LivenessPath, readiness: config.ReadinessPath}
 	return nil
 }
 
-// GetBackendStats just a hacky get stats/connection and logs it.
-// will be replaced by prometheus/whatever metrics.
-func (l *LBLight) GetBackendStats() error {
+// buildRoutingTable generates the BackendRouters/Backends for config. Any Backend in oldRoutes that
+// matches one in config is reused instead of creating a new one. Rate limiters use store if not nil.
+func buildRoutingTable(config Config, oldRoutes *routingTable, store *rateLimitStore) (*routingTable, error) {
+
+	existingBackends := make(map[string]*Backend)
+	existingLimiters := make(map[string]*rateLimiter)
+	if oldRoutes != nil {
+		for _, ber := range oldRoutes.allBackendRouters {
+			if ber.rateLimiter != nil {
+				existingLimiters[ber.Name] = ber.rateLimiter
+			}
+			for _, be := range ber.getBackends() {
+				existingBackends[backendKey(ber.Name, be.Host, be.Port)] = be
+			}
+		}
+	}
 
-	for _, ber := range l.allBackendRouters {
-		for _, be := range ber.backends {
-			err := be.LogStats()
+	newRoutes := newRoutingTable()
+	for _, beConfig := range config.BackendRouterConfigs {
+		pathMap := make(map[string]bool)
+		for _, path := range beConfig.AcceptedPaths {
+			pathMap[path] = true
+		}
+
+		ber := NewBackendRouter(beConfig.AcceptedHeaders, pathMap, ParseBackendSelectionString(beConfig.SelectionMethod))
+		if len(beConfig.AcceptedHosts) > 0 {
+			ber.acceptedHosts = make(map[string]bool)
+			for _, host := range beConfig.AcceptedHosts {
+				ber.acceptedHosts[strings.ToLower(host)] = true
+			}
+		}
+		ber.Name = beConfig.RouterName()
+		ber.PreserveHost = beConfig.PreserveHost
+		ber.adaptiveConcurrency = beConfig.AdaptiveConcurrency
+		ber.MaxRequestBodyBytes = beConfig.MaxRequestBodyBytes
+		ber.Priority = beConfig.Priority
+
+		if beConfig.Match.Enabled() {
+			matcher, err := newRouteMatcher(beConfig.Match)
 			if err != nil {
-				return err
+				return nil, err
 			}
+			ber.matcher = matcher
+		}
+
+		pathRewriter, err := newPathRewriter(beConfig.StripPrefix, beConfig.AddPrefix, beConfig.PathRewrites)
+		if err != nil {
+			return nil, err
+		}
+		ber.pathRewriter = pathRewriter
+
+		headerRules, err := newHeaderRules(beConfig.Headers)
+		if err != nil {
+			return nil, err
+		}
+		ber.headerRules = headerRules
+
+		errorPages, err := newErrorPages(beConfig.ErrorPages)
+		if err != nil {
+			return nil, err
+		}
+		ber.errorPages = errorPages
+
+		// clients keep their buckets across reloads unless the limit changed.
+		if beConfig.RateLimit.Enabled() {
+			limiter, ok := existingLimiters[ber.Name]
+			if !ok || limiter.config != beConfig.RateLimit || limiter.store != store {
+				limiter = newRateLimiter(beConfig.RateLimit, ber.Name, store)
+			}
+			ber.rateLimiter = limiter
+		}
+
+		// now add backends that the router will route to.
+		for _, bec := range beConfig.BackendConfigs {
+			// only add if max connections > 0. (can use 0 to disable).
+			if bec.MaxConnections > 0 {
+				be, ok := existingBackends[backendKey(ber.Name, bec.Host, bec.Port)]
+
+				// existing connections were made with/without PROXY protocol, so need a new backend if it changed.
+				if ok && be.SendProxyProtocol == bec.SendProxyProtocol {
+					// state (draining/disabled) set through the admin API is kept.
+					be.SetMaxConnections(bec.MaxConnections)
+				} else {
+					be = NewBackend(bec.Host, bec.Port, bec.MaxConnections)
+					be.SendProxyProtocol = bec.SendProxyProtocol
+				}
+				be.SetWeight(bec.GetWeight())
+				be.SetAdaptiveConcurrency(ber.adaptiveConcurrency)
+				ber.AddBackend(be)
+			}
+		}
+
+		err = newRoutes.addBackendRouter(ber)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	return nil
+	// default/fallback routers are referred to by name, so can only be linked up once they all exist.
+	if config.DefaultRouter != "" {
+		defaultRouter, err := newRoutes.getBackendRouterByName(config.DefaultRouter)
+		if err != nil {
+			return nil, err
+		}
+		newRoutes.defaultRouter = defaultRouter
+	}
+	for _, beConfig := range config.BackendRouterConfigs {
+		if beConfig.FallbackRouter == "" {
+			continue
+		}
+		ber, _ := newRoutes.getBackendRouterByName(beConfig.RouterName())
+		fallback, err := newRoutes.getBackendRouterByName(beConfig.FallbackRouter)
+		if ber == nil || err != nil {
+			return nil, fmt.Errorf("Unable to find fallback router %s for %s", beConfig.FallbackRouter, beConfig.RouterName())
+		}
+		ber.fallback = fallback
+	}
+
+	return newRoutes, nil
 }
 
-// getBackend.... TODO(kpfaulkner) make real!
-// just gets first match for now.
-func (l *LBLight) getBackend(req *http.Request) (*Backend, error) {
+// closeRemovedBackends closes the idle connections of Backends in oldRoutes that aren't carried across
+// to newRoutes, otherwise they'd be held open until the idle timeout.
+func closeRemovedBackends(oldRoutes *routingTable, newRoutes *routingTable) {
+	if oldRoutes == nil {
+		return
+	}
 
-	// just return first one
-	backendRouter, err := l.GetBackendRouterByPathPrefix(req.URL.Path)
-	if err != nil {
-		return nil, err
+	kept := make(map[*Backend]bool)
+	for _, ber := range newRoutes.allBackendRouters {
+		for _, be := range ber.getBackends() {
+			kept[be] = true
+		}
 	}
 
-	// check if we have a backend for this router... if not, make one.
-	backend, err := backendRouter.GetBackend()
-	return backend, err
+	for _, ber := range oldRoutes.allBackendRouters {
+		for _, be := range ber.getBackends() {
+			if !kept[be] {
+				be.CloseIdleConnections()
+			}
+		}
+	}
+}
+
+// backendKey is used to identify the "same" backend across reloads.
+func backendKey(routerName string, host string, port int) string {
+	return fmt.Sprintf("%s|%s|%d", routerName, host, port)
+}
+
+// MetricsHandler serves Prometheus metrics for LBLight and all of its backends.
+func (l *LBLight) MetricsHandler() http.Handler {
+	return l.metrics.handler()
+}
 
+// getBackendRouter returns the router for the request, checking routers with a Match first.
+func (l *LBLight) getBackendRouter(req *http.Request, info *requestInfo) (*BackendRouter, error) {
+	return l.getRoutingTable().getBackendRouterForRequest(req, info.clientIP(req))
 }
 
-// handleRequestsAndRedirect determines which BackendRouter should be used for the incoming request.
+// handleRequestsAndRedirect is the entry point for all traffic. Sets up the per request tracking
+// then passes the request on to proxyRequest.
 func (l *LBLight) handleRequestsAndRedirect(res http.ResponseWriter, req *http.Request) {
 	//log.Infof("handleRequestsAndRedirect : %s", req.RequestURI)
 
+	if l.serveHealth(res, req) {
+		return
+	}
+
+	info := &requestInfo{startTime: time.Now(), requestID: requestIDFromRequest(req), forwarding: l.getForwarder(), errorPages: l.getErrorPages(), metrics: l.metrics}
+	info.clientAddr = tcpAddrFromRequest(req)
+	info.localAddr = localAddrFromRequest(req)
+
+	atomic.AddInt64(&l.inFlight, 1)
+	defer atomic.AddInt64(&l.inFlight, -1)
+
+	// forwarded to the backend as part of the request headers, and returned to the client
+	// on every response (including errors generated by LBLight).
+	req.Header.Set(RequestIDHeader, info.requestID)
+	res.Header().Set(RequestIDHeader, info.requestID)
+	info.inbound = newInboundRequest(req)
+
+	req, span := startServerSpan(l.tracer, req)
+	req = req.WithContext(context.WithValue(req.Context(), RequestInfoID, info))
+	recorder := newResponseRecorder(res)
+	defer func() {
+		endServerSpan(span, req, info, recorder.Status())
+	}()
+
+	body := &countingReader{ReadCloser: req.Body}
+	if req.Body != nil {
+		req.Body = body
+	}
+
+	if l.accessLog != nil {
+		defer func() {
+			l.accessLog.log(req, recorder, info, body.bytes)
+		}()
+	}
+
+	l.proxyRequest(recorder, req, info)
+}
+
+// proxyRequest determines which BackendRouter should be used for the incoming request.
+func (l *LBLight) proxyRequest(res *responseRecorder, req *http.Request, info *requestInfo) {
+
 	retries := GetRetryFromContext(req)
 	if retries > RetryAttempts {
-		log.Warningf("Max retries for query, failing: %s %s", req.RemoteAddr, req.URL.Path)
-		http.Error(res, "Service not available", http.StatusServiceUnavailable)
+		requestLog(req).Warningf("Max retries for query, failing: %s %s", req.RemoteAddr, req.URL.Path)
+		writeError(res, req, http.StatusServiceUnavailable, "Service not available")
+		l.metrics.observeRejection("", http.StatusServiceUnavailable)
+		return
+	}
+
+	if !l.checkURLLength(res, req) {
+		return
+	}
+
+	router, err := l.getBackendRouter(req, info)
+	if err != nil {
+		l.writeNotFound(res, req)
+		return
+	}
+	info.router = router
+
+	// retries have already been counted.
+	if retries == 0 && !l.checkRateLimit(res, req, router, info) {
+		return
+	}
+
+	if !l.checkBodySize(res, req, router, info) {
 		return
 	}
 
-	backend, err := l.getBackend(req)
+	backend, used, err := router.getBackendOrFallback()
 	if err != nil {
-		log.Errorf("Unable to find backend for URL %s", req.RequestURI)
+		requestLog(req).Errorf("Unable to find backend for URL %s : %s", req.RequestURI, err.Error())
+		writeError(res, req, http.StatusServiceUnavailable, "Service not available")
+		l.metrics.observeRejection(router.Name, http.StatusServiceUnavailable)
+		return
+	}
+	if used != router {
+		requestLog(req).Warnf("No backends available for router %s, using fallback router %s", router.Name, used.Name)
+		router = used
+		info.router = router
+	}
+	info.backend = backend
+
+	limiter := backend.getConcurrencyLimiter()
+	if limiter != nil && !limiter.acquire() {
+		requestLog(req).Warnf("Backend %s at concurrency limit %d, shedding request", backend.Host, limiter.getLimit())
+		writeError(res, req, http.StatusServiceUnavailable, "Service overloaded")
+		l.metrics.observeRejection(router.Name, http.StatusServiceUnavailable)
 		return
 	}
 
+	// deferred, as ReverseProxy panics with http.ErrAbortHandler if copying the response body fails.
+	defer func() {
+		if info.upstreamStart.IsZero() {
+			// never reached the backend.
+			if limiter != nil {
+				limiter.release(0, false)
+			}
+			return
+		}
+		if limiter != nil {
+			limiter.release(time.Since(info.upstreamStart), isOverloaded(res.Status(), info.retries))
+		}
+		l.metrics.observeRequest(router.Name, backend.Host, res.Status(), time.Since(info.startTime))
+	}()
+
 	backendConnection, err := backend.GetBackendConnection()
 	if err != nil {
 		// Assumption (not really valid) that we're under load so we're going to return 429
-		log.Errorf("Unable to find backendconnection for URL %s", req.RequestURI)
-		res.WriteHeader(http.StatusTooManyRequests)
+		requestLog(req).Errorf("Unable to find backendconnection for URL %s", req.RequestURI)
+		writeError(res, req, http.StatusTooManyRequests, "Too many requests")
+		l.metrics.observeRejection(router.Name, http.StatusTooManyRequests)
 		return
 	}
 	defer backendConnection.SetInUse(false) // once finished with connection, then release back to pool.
 
+	backend.incInFlight()
+	defer backend.decInFlight()
+
+	info.upstreamStart = time.Now()
 	backendConnection.ReverseProxy.ServeHTTP(res, req)
-	return
 }
 
 func (l *LBLight) ListenAndServeTraffic(certCRTPath string, certKeyPath string) error {
-	var err error
+	err := l.ListenTraffic()
+	if err != nil {
+		return err
+	}
+	return l.ServeTraffic(certCRTPath, certKeyPath)
+}
+
+// ListenTraffic opens (or takes over from a previous process) the traffic listener, without accepting
+// any connections yet. Connections are queued until ServeTraffic is called.
+func (l *LBLight) ListenTraffic() error {
+	listener, err := listen(trafficListenerName, l.listenAddr)
+	if err != nil {
+		log.Errorf("Unable to listen on %s : %s", l.listenAddr, err.Error())
+		return err
+	}
+
+	l.serverMux.Lock()
+	l.listener = listener
+	l.serverMux.Unlock()
+	return nil
+}
+
+// ServeTraffic handles connections on the listener opened by ListenTraffic until Shutdown is called.
+func (l *LBLight) ServeTraffic(certCRTPath string, certKeyPath string) error {
+	l.serverMux.Lock()
+	listener := l.listener
+	l.serverMux.Unlock()
+	if listener == nil {
+		return fmt.Errorf("ListenTraffic must be called before ServeTraffic")
+	}
+	defer listeners.forget(trafficListenerName)
+
+	if l.proxyProtocolTrusted != nil {
+		log.Infof("ListenAndServeTraffic : accepting PROXY protocol")
+		listener = proxyProtocolListener(listener, l.proxyProtocolTrusted)
+	}
+
+	// already shutting down.
+	server, err := l.newServer()
+	if err != nil {
+		listener.Close()
+		return nil
+	}
+	atomic.StoreInt32(&l.serving, 1)
+	defer atomic.StoreInt32(&l.serving, 0)
 
 	// If using behind a TLS termination endpoint (eg Azure LB) then listening for TLS traffic is wrong, since it's already
 	// been "stripped" of the TLS encryption at this point.
 	if l.tlsListener {
-		log.Infof("ListenAndServeTraffic : port %d : crt %s : key %s", l.port, certCRTPath, certKeyPath)
-		err = http.ListenAndServeTLS(fmt.Sprintf(":%d", l.port), certCRTPath, certKeyPath, http.HandlerFunc(l.handleRequestsAndRedirect))
+		log.Infof("ListenAndServeTraffic : address %s : crt %s : key %s", l.listenAddr, certCRTPath, certKeyPath)
+		err = server.ServeTLS(listener, certCRTPath, certKeyPath)
 	} else {
-		err = http.ListenAndServe(fmt.Sprintf(":%d", l.port), http.HandlerFunc(l.handleRequestsAndRedirect))
+		log.Infof("ListenAndServeTraffic : address %s", l.listenAddr)
+		err = server.Serve(listener)
+	}
+
+	// stopped by Shutdown, which carries on draining the in-flight requests.
+	if err == http.ErrServerClosed {
+		return nil
 	}
 	if err != nil {
 		log.Errorf("SERVER BLEW UP!! %s", err.Error())
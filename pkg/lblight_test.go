@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func generateTestConfig(paths ...string) Config {
+	config := Config{}
+	for _, path := range paths {
+		berConfig := BackendRouterConfig{SelectionMethod: "RoundRobin", AcceptedPaths: []string{path}}
+		berConfig.BackendConfigs = []BackendConfig{{Host: "http://10.0.0.1:5000", Port: 5000, MaxConnections: 10}}
+		config.BackendRouterConfigs = append(config.BackendRouterConfigs, berConfig)
+	}
+	return config
+}
+
+func TestReloadSuccess(t *testing.T) {
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(generateTestConfig("/foo", "/bar"))
+	assert.Nil(t, err, "Error not expected")
+
+	ber, err := lbl.GetBackendRouterByPathPrefix("/bar/baz")
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, "/bar", ber.Name)
+}
+
+func TestReloadKeepsUnchangedBackends(t *testing.T) {
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(generateTestConfig("/foo"))
+	assert.Nil(t, err, "Error not expected")
+
+	oldRouter, _ := lbl.GetBackendRouterByExactPathPrefix("/foo")
+	oldBackend, _ := oldRouter.GetBackend()
+	oldBackend.SetIsAlive(false)
+
+	err = lbl.Reload(generateTestConfig("/foo", "/bar"))
+	assert.Nil(t, err, "Error not expected")
+
+	newRouter, _ := lbl.GetBackendRouterByExactPathPrefix("/foo")
+	assert.True(t, oldRouter != newRouter, "Router should have been rebuilt")
+	assert.Same(t, oldBackend, newRouter.getBackends()[0], "Backend should have been reused")
+	assert.False(t, newRouter.getBackends()[0].IsAlive(), "Health state should have been kept")
+}
+
+func TestReloadClosesRemovedBackendConnections(t *testing.T) {
+	var closed int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			atomic.AddInt32(&closed, 1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	lbl := generateTestLBLight(t, backend.URL)
+	res := httptest.NewRecorder()
+	lbl.handleRequestsAndRedirect(res, httptest.NewRequest(http.MethodGet, "/foo", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	// unchanged backend keeps its keep-alive connection.
+	config := generateTestConfig("/foo")
+	config.BackendRouterConfigs[0].BackendConfigs[0].Host = backend.URL
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&closed), "Expected connection to kept backend to stay open")
+
+	err = lbl.Reload(generateTestConfig("/foo"))
+	assert.Nil(t, err, "Error not expected")
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&closed) == 1
+	}, 5*time.Second, 10*time.Millisecond, "Expected idle connection to removed backend to be closed")
+}
+
+func TestReloadInvalidConfigKeepsExistingRoutes(t *testing.T) {
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(generateTestConfig("/foo"))
+	assert.Nil(t, err, "Error not expected")
+
+	err = lbl.Reload(generateTestConfig("/foo", "/foo"))
+	assert.NotNil(t, err, "Duplicate path should fail validation")
+
+	_, err = lbl.GetBackendRouterByExactPathPrefix("/foo")
+	assert.Nil(t, err, "Existing route should still be registered")
+}
+
+func TestHostRouting(t *testing.T) {
+	config := generateTestConfig("/", "/foo", "/foo/bar", "/foo")
+	config.BackendRouterConfigs[2].Name = "any-foo-bar"
+	config.BackendRouterConfigs[3].Name = "api-foo"
+	config.BackendRouterConfigs[3].AcceptedHosts = []string{"api.example.com"}
+	config.BackendRouterConfigs = append(config.BackendRouterConfigs, BackendRouterConfig{Name: "wildcard", AcceptedHosts: []string{"*.example.com"},
+		BackendConfigs: []BackendConfig{{Host: "http://10.0.0.2:5000", Port: 5000, MaxConnections: 10}}})
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+
+	tests := []struct {
+		host   string
+		path   string
+		router string
+	}{
+		{"other.com", "/foo/bar/baz", "any-foo-bar"},
+		{"other.com", "/foo/baz", "/foo"},
+		{"other.com", "/baz", "/"},
+		{"api.example.com", "/foo/bar", "api-foo"},
+		{"API.example.com:8443", "/foo", "api-foo"},
+		{"api.example.com", "/baz", "wildcard"},
+		{"a.b.example.com", "/foo", "wildcard"},
+		{"example.com", "/foo", "/foo"},
+	}
+	for _, test := range tests {
+		ber, err := lbl.GetBackendRouterByHostAndPath(test.host, test.path)
+		assert.Nil(t, err, "Error not expected")
+		assert.Equal(t, test.router, ber.Name, "Routing %s%s", test.host, test.path)
+	}
+}
+
+func TestHostRoutingConflicts(t *testing.T) {
+	config := generateTestConfig("/foo", "/foo")
+	config.BackendRouterConfigs[0].AcceptedHosts = []string{"a.example.com"}
+	config.BackendRouterConfigs[1].AcceptedHosts = []string{"b.example.com"}
+	assert.Nil(t, config.Validate(), "Same path on different hosts should be allowed")
+	assert.Equal(t, "a.example.com,/foo", config.BackendRouterConfigs[0].RouterName())
+
+	config.BackendRouterConfigs[1].AcceptedHosts = []string{"b.example.com", "A.example.com"}
+	assert.NotNil(t, config.Validate(), "Same path on the same host should fail validation")
+
+	config.BackendRouterConfigs[1].AcceptedHosts = []string{"*.*.example.com"}
+	assert.NotNil(t, config.Validate(), "Invalid wildcard should fail validation")
+
+	lbl := NewLBLight(4000, false)
+	ber := NewBackendRouter(nil, map[string]bool{"/foo": true}, BackendRoundRobin)
+	ber.acceptedHosts = map[string]bool{"a.example.com": true}
+	assert.Nil(t, lbl.AddBackendRouter(ber), "Error not expected")
+	ber = NewBackendRouter(nil, map[string]bool{"/foo": true}, BackendRoundRobin)
+	ber.acceptedHosts = map[string]bool{"a.example.com": true}
+	assert.NotNil(t, lbl.AddBackendRouter(ber), "Expected conflict")
+	ber = NewBackendRouter(nil, map[string]bool{"/foo": true}, BackendRoundRobin)
+	assert.Nil(t, lbl.AddBackendRouter(ber), "Any host router shouldn't conflict with a host router")
+}
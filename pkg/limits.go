@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// errRequestBodyTooLarge is returned when reading past a router's MaxRequestBodyBytes.
+var errRequestBodyTooLarge = errors.New("request body too large")
+
+// limitedBody stops reading the request body once it goes over the router's limit. Unlike checking
+// Content-Length this also catches chunked uploads, while the body is being streamed to the backend.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+
+	// set (atomically) once the limit has been hit.
+	exceeded int32
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&lb.exceeded) == 1 {
+		return 0, errRequestBodyTooLarge
+	}
+
+	// read one byte past the limit, to tell a body of exactly the limit from one that is too large.
+	if int64(len(p)) > lb.remaining+1 {
+		p = p[:lb.remaining+1]
+	}
+	n, err := lb.ReadCloser.Read(p)
+	if int64(n) <= lb.remaining {
+		lb.remaining -= int64(n)
+		return n, err
+	}
+
+	n = int(lb.remaining)
+	lb.remaining = 0
+	atomic.StoreInt32(&lb.exceeded, 1)
+	return n, errRequestBodyTooLarge
+}
+
+// isExceeded returns true if the body went over the limit.
+func (lb *limitedBody) isExceeded() bool {
+	return atomic.LoadInt32(&lb.exceeded) == 1
+}
+
+// checkURLLength rejects the request with a 414 if the URL is longer than the configured limit.
+func (l *LBLight) checkURLLength(res http.ResponseWriter, req *http.Request) bool {
+	l.routesMux.RLock()
+	maxURLLength := l.maxURLLength
+	l.routesMux.RUnlock()
+
+	if maxURLLength <= 0 || len(req.RequestURI) <= maxURLLength {
+		return true
+	}
+
+	requestLog(req).Warnf("URL length %d is over the limit of %d", len(req.RequestURI), maxURLLength)
+	writeError(res, req, http.StatusRequestURITooLong, "URI too long")
+	l.metrics.observeRejection("", http.StatusRequestURITooLong)
+	return false
+}
+
+// checkBodySize applies the router's MaxRequestBodyBytes. A request that declares a larger Content-Length
+// gets a 413 straight away, otherwise the body is cut off once it goes over the limit as it is sent to the
+// backend (and the ErrorHandler returns the 413).
+func (l *LBLight) checkBodySize(res http.ResponseWriter, req *http.Request, router *BackendRouter, info *requestInfo) bool {
+	maxBytes := router.MaxRequestBodyBytes
+	if maxBytes <= 0 || req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+
+	if req.ContentLength > maxBytes {
+		requestLog(req).Warnf("Request body of %d bytes is over the limit of %d for router %s", req.ContentLength, maxBytes, router.Name)
+		writeError(res, req, http.StatusRequestEntityTooLarge, "Request body too large")
+		l.metrics.observeRejection(router.Name, http.StatusRequestEntityTooLarge)
+		return false
+	}
+
+	info.body = &limitedBody{ReadCloser: req.Body, remaining: maxBytes}
+	req.Body = info.body
+	return true
+}
+
+// SetMaxHeaderBytes sets the maximum size of request headers (including the request line). Larger requests
+// get a 431. 0 uses the net/http default (1MB). Must be called before ListenAndServeTraffic.
+func (l *LBLight) SetMaxHeaderBytes(maxHeaderBytes int) {
+	l.maxHeaderBytes = maxHeaderBytes
+}
@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// generateLimitedLBLight returns an LBLight for /foo with a body limit, proxying to a backend that
+// reads the whole body and sends back how many bytes it got.
+func generateLimitedLBLight(t *testing.T, maxBodyBytes int64, maxURLLength int) (*LBLight, *httptest.Server) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d", len(body))
+	}))
+
+	config := generateTestConfig("/foo")
+	config.BackendRouterConfigs[0].BackendConfigs[0].Host = backend.URL
+	config.BackendRouterConfigs[0].MaxRequestBodyBytes = maxBodyBytes
+	config.MaxURLLength = maxURLLength
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+	return lbl, backend
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	lbl, backend := generateLimitedLBLight(t, 10, 0)
+	defer backend.Close()
+
+	send := func(body string, contentLength int64) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/foo", strings.NewReader(body))
+		req.ContentLength = contentLength
+		res := httptest.NewRecorder()
+		lbl.handleRequestsAndRedirect(res, req)
+		return res
+	}
+
+	res := send("0123456789", 10)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "10", res.Body.String())
+
+	// rejected from Content-Length without going to the backend.
+	res = send("0123456789A", 11)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code)
+
+	// chunked, so only found out while streaming.
+	res = send("0123456789", -1)
+	assert.Equal(t, http.StatusOK, res.Code)
+	res = send(strings.Repeat("x", 100000), -1)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code)
+}
+
+func TestLimitedBody(t *testing.T) {
+	lb := &limitedBody{ReadCloser: ioutil.NopCloser(strings.NewReader("0123456789")), remaining: 5}
+	data, err := ioutil.ReadAll(lb)
+	assert.Equal(t, errRequestBodyTooLarge, err)
+	assert.Equal(t, "01234", string(data))
+	assert.True(t, lb.isExceeded(), "Expected limit exceeded")
+
+	lb = &limitedBody{ReadCloser: ioutil.NopCloser(strings.NewReader("0123456789")), remaining: 10}
+	data, err = ioutil.ReadAll(lb)
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, "0123456789", string(data))
+	assert.False(t, lb.isExceeded(), "Expected limit not exceeded")
+}
+
+func TestURLLengthLimit(t *testing.T) {
+	lbl, backend := generateLimitedLBLight(t, 0, 17)
+	defer backend.Close()
+
+	res := httptest.NewRecorder()
+	lbl.handleRequestsAndRedirect(res, httptest.NewRequest(http.MethodGet, "/foo?a=1234567890", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	res = httptest.NewRecorder()
+	lbl.handleRequestsAndRedirect(res, httptest.NewRequest(http.MethodGet, "/foo?a=12345678901", nil))
+	assert.Equal(t, http.StatusRequestURITooLong, res.Code)
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	lbl, backend := generateLimitedLBLight(t, 0, 0)
+	defer backend.Close()
+	lbl.SetMaxHeaderBytes(1024)
+	addr, _ := startTestTraffic(t, lbl)
+	defer lbl.Shutdown(context.Background())
+
+	send := func(headerSize int) int {
+		conn, err := net.Dial("tcp", addr)
+		assert.Nil(t, err, "Error not expected")
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		fmt.Fprintf(conn, "GET /foo HTTP/1.1\r\nHost: test\r\nX-Big: %s\r\n\r\n", strings.Repeat("x", headerSize))
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		assert.Nil(t, err, "Error not expected")
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, send(100))
+
+	// net/http allows 4KB over MaxHeaderBytes.
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, send(10000))
+}
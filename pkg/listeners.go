@@ -0,0 +1,203 @@
+package pkg
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// InheritedListenersEnv is set when a new LBLight process is started to take over from a running one
+// (binary upgrade). The listening sockets are passed as extra files starting at fd 3, and this lists
+// their names in the same order, comma separated. The new process uses these instead of listening
+// itself, so no connections are refused during the handoff.
+const InheritedListenersEnv string = "LBLIGHT_INHERITED_LISTENERS"
+
+const (
+	trafficListenerName string = "traffic"
+	adminListenerName   string = "admin"
+
+	// first fd of files passed with exec.Cmd.ExtraFiles.
+	firstInheritedFD = 3
+)
+
+// listenerSet keeps track of the listeners in use (so they can be handed to a new process) and any
+// listeners inherited from the previous process or systemd.
+type listenerSet struct {
+	active    map[string]net.Listener
+	inherited map[string]inheritedListener
+	loaded    bool
+	mux       sync.Mutex
+}
+
+// inheritedListener is a listener that was already open when LBLight started.
+type inheritedListener struct {
+	listener net.Listener
+
+	// where it came from, for logging. Listeners from systemd are used by name whatever their address,
+	// since the socket unit decides where LBLight listens.
+	source  string
+	systemd bool
+}
+
+func newListenerSet() listenerSet {
+	return listenerSet{active: make(map[string]net.Listener), inherited: make(map[string]inheritedListener)}
+}
+
+var listeners = newListenerSet()
+
+// listen returns a listener for addr. If the previous process handed over a listener with the same name
+// and address, or systemd passed one with the same name or address, then that is used. Otherwise a new
+// one is created.
+func listen(name string, addr string) (net.Listener, error) {
+	return listeners.listen(name, addr)
+}
+
+// ListenerFiles returns duplicates of the active listening sockets (for exec.Cmd.ExtraFiles) and the
+// value InheritedListenersEnv should have in the new process. The caller should close the files once
+// the new process has started.
+func ListenerFiles() ([]*os.File, string, error) {
+	return listeners.files()
+}
+
+// CloseUnusedInheritedListeners closes any listeners passed on by the previous process (or systemd) that
+// this process hasn't used (eg. the admin API has been disabled in the new config).
+func CloseUnusedInheritedListeners() {
+	listeners.closeUnused()
+}
+
+func (ls *listenerSet) listen(name string, addr string) (net.Listener, error) {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+	ls.loadInherited()
+
+	inherited, ok := ls.inherited[name]
+	if ok {
+		delete(ls.inherited, name)
+		if inherited.systemd || sameListenAddr(inherited.listener.Addr(), addr) {
+			log.Infof("Using %s listener on %s from %s", name, inherited.listener.Addr(), inherited.source)
+			ls.active[name] = inherited.listener
+			return inherited.listener, nil
+		}
+		log.Warnf("Inherited %s listener is on %s not %s, closing it", name, inherited.listener.Addr(), addr)
+		inherited.listener.Close()
+	}
+
+	// unnamed sockets from systemd are matched on address.
+	for key, inherited := range ls.inherited {
+		if sameListenAddr(inherited.listener.Addr(), addr) {
+			delete(ls.inherited, key)
+			log.Infof("Using %s listener on %s from %s", name, inherited.listener.Addr(), inherited.source)
+			ls.active[name] = inherited.listener
+			return inherited.listener, nil
+		}
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ls.active[name] = listener
+	return listener, nil
+}
+
+// loadInherited picks up the listeners passed by the previous process or systemd (if any). Only done once.
+func (ls *listenerSet) loadInherited() {
+	if ls.loaded {
+		return
+	}
+	ls.loaded = true
+
+	names := os.Getenv(InheritedListenersEnv)
+	if names != "" {
+		// not for any processes we start.
+		os.Unsetenv(InheritedListenersEnv)
+		ls.addInherited(strings.Split(names, ","), "previous process", false)
+	}
+
+	systemdNames := systemdListenNames()
+	if systemdNames != nil {
+		ls.addInherited(systemdNames, "systemd", true)
+	}
+}
+
+// addInherited wraps the sockets at fd 3 onwards as listeners.
+func (ls *listenerSet) addInherited(names []string, source string, systemd bool) {
+	for i, name := range names {
+		file := os.NewFile(uintptr(firstInheritedFD+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			log.Errorf("Unable to use %s listener from %s : %s", name, source, err.Error())
+			continue
+		}
+		ls.inherited[name] = inheritedListener{listener: listener, source: source, systemd: systemd}
+	}
+}
+
+func (ls *listenerSet) files() ([]*os.File, string, error) {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+
+	var files []*os.File
+	var names []string
+	for name, listener := range ls.active {
+		filer, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			closeFiles(files)
+			return nil, "", fmt.Errorf("%s listener can't be handed over", name)
+		}
+		file, err := filer.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, "", fmt.Errorf("Unable to get file for %s listener : %s", name, err.Error())
+		}
+		files = append(files, file)
+		names = append(names, name)
+	}
+	return files, strings.Join(names, ","), nil
+}
+
+func (ls *listenerSet) closeUnused() {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+	ls.loadInherited()
+
+	for name, inherited := range ls.inherited {
+		log.Infof("Closing unused %s listener from %s", name, inherited.source)
+		inherited.listener.Close()
+		delete(ls.inherited, name)
+	}
+}
+
+// forget stops tracking the listener, once it's closed.
+func (ls *listenerSet) forget(name string) {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+	delete(ls.active, name)
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// sameListenAddr returns true if the listener address is what listening on addr would give.
+// ":4000" matches "[::]:4000" and "0.0.0.0:4000".
+func sameListenAddr(listenerAddr net.Addr, addr string) bool {
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return false
+	}
+	have, ok := listenerAddr.(*net.TCPAddr)
+	if !ok || have.Port != want.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return have.IP == nil || have.IP.IsUnspecified()
+	}
+	return want.IP.Equal(have.IP)
+}
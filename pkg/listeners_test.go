@@ -0,0 +1,73 @@
+//go:build !windows
+// +build !windows
+
+package pkg
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// TestInheritedListenerHelper is run as the new process by TestListenerHandoff. It serves a single
+// request on the inherited listener.
+func TestInheritedListenerHelper(t *testing.T) {
+	addr := os.Getenv("LBLIGHT_TEST_HELPER_ADDR")
+	if addr == "" {
+		return
+	}
+
+	ls := newListenerSet()
+	listener, err := ls.listen(trafficListenerName, addr)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	served := make(chan struct{})
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "new process %d", os.Getpid())
+		close(served)
+	}))
+	<-served
+	listener.Close()
+	os.Exit(0)
+}
+
+func TestListenerHandoff(t *testing.T) {
+	ls := newListenerSet()
+	listener, err := ls.listen(trafficListenerName, "127.0.0.1:0")
+	assert.Nil(t, err, "Error not expected")
+	addr := listener.Addr().String()
+
+	files, names, err := ls.files()
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, trafficListenerName, names)
+
+	cmd := exec.Command(os.Args[0], "-test.run", "^TestInheritedListenerHelper$")
+	cmd.Env = append(os.Environ(), InheritedListenersEnv+"="+names, "LBLIGHT_TEST_HELPER_ADDR="+addr)
+	cmd.ExtraFiles = files
+	err = cmd.Start()
+	assert.Nil(t, err, "Error not expected")
+	closeFiles(files)
+
+	// old process stops listening, new process should still get the connection.
+	listener.Close()
+	res, err := http.Get("http://" + addr)
+	assert.Nil(t, err, "Error not expected")
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, fmt.Sprintf("new process %d", cmd.Process.Pid), string(body))
+	assert.Nil(t, cmd.Wait(), "Error not expected")
+}
+
+func TestSameListenAddr(t *testing.T) {
+	assert.True(t, sameListenAddr(&net.TCPAddr{IP: net.IPv6unspecified, Port: 4000}, ":4000"))
+	assert.True(t, sameListenAddr(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4000}, "127.0.0.1:4000"))
+	assert.False(t, sameListenAddr(&net.TCPAddr{IP: net.IPv6unspecified, Port: 4000}, ":4001"))
+	assert.False(t, sameListenAddr(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4000}, ":4000"))
+}
@@ -0,0 +1,123 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+// metrics holds the Prometheus metrics for an LBLight instance. Each LBLight has its own registry
+// so multiple instances (eg. in tests) don't clash.
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	retries         *prometheus.CounterVec
+	rejections      *prometheus.CounterVec
+}
+
+func newMetrics(l *LBLight) *metrics {
+	m := metrics{}
+	m.registry = prometheus.NewRegistry()
+
+	m.requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lblight_requests_total",
+		Help: "Requests proxied to backends, by router, backend and status code class (2xx, 4xx etc).",
+	}, []string{"router", "backend", "code"})
+
+	m.requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lblight_request_duration_seconds",
+		Help:    "Time taken to proxy requests to backends, including retries.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"router", "backend"})
+
+	m.retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lblight_retries_total",
+		Help: "Requests to backends that failed and were retried.",
+	}, []string{"router", "backend"})
+
+	m.rejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lblight_rejected_requests_total",
+		Help: "Requests rejected by LBLight itself (eg. 429 no connections available, 503 retries exhausted).",
+	}, []string{"router", "code"})
+
+	m.registry.MustRegister(m.requests, m.requestDuration, m.retries, m.rejections)
+	m.registry.MustRegister(&backendCollector{lbl: l})
+	m.registry.MustRegister(prometheus.NewGoCollector())
+	m.registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	return &m
+}
+
+// codeClass converts a status code to 2xx, 4xx etc, to keep label cardinality down.
+func codeClass(status int) string {
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+// observeRequest records a request that was proxied to a backend.
+func (m *metrics) observeRequest(routerName string, backendHost string, status int, duration time.Duration) {
+	m.requests.WithLabelValues(routerName, backendHost, codeClass(status)).Inc()
+	m.requestDuration.WithLabelValues(routerName, backendHost).Observe(duration.Seconds())
+}
+
+// observeRetry records a failed request to a backend being retried.
+func (m *metrics) observeRetry(routerName string, backendHost string) {
+	m.retries.WithLabelValues(routerName, backendHost).Inc()
+}
+
+// observeRejection records a request LBLight rejected without it reaching a backend.
+func (m *metrics) observeRejection(routerName string, status int) {
+	m.rejections.WithLabelValues(routerName, fmt.Sprintf("%d", status)).Inc()
+}
+
+// handler serves the metrics in the Prometheus text format.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+var (
+	backendInFlightDesc = prometheus.NewDesc("lblight_backend_in_flight_requests",
+		"Requests currently being proxied to the backend.", []string{"router", "backend"}, nil)
+	backendPoolSizeDesc = prometheus.NewDesc("lblight_backend_pool_size",
+		"BackendConnections in the backend pool.", []string{"router", "backend"}, nil)
+	backendMaxConnectionsDesc = prometheus.NewDesc("lblight_backend_max_connections",
+		"Maximum BackendConnections allowed for the backend.", []string{"router", "backend"}, nil)
+	backendConcurrencyLimitDesc = prometheus.NewDesc("lblight_backend_concurrency_limit",
+		"Current adaptive concurrency limit for the backend, only reported if enabled.", []string{"router", "backend"}, nil)
+	backendHealthyDesc = prometheus.NewDesc("lblight_backend_healthy",
+		"1 if the backend passed its last health check, 0 if not.", []string{"router", "backend"}, nil)
+)
+
+// backendCollector reports the current state of every backend at scrape time. Done at scrape time
+// (instead of keeping gauges up to date) so routers/backends removed by a reload disappear.
+type backendCollector struct {
+	lbl *LBLight
+}
+
+func (bc *backendCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backendInFlightDesc
+	ch <- backendPoolSizeDesc
+	ch <- backendMaxConnectionsDesc
+	ch <- backendConcurrencyLimitDesc
+	ch <- backendHealthyDesc
+}
+
+func (bc *backendCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, router := range bc.lbl.GetRouterInfo() {
+		for _, be := range router.Backends {
+			healthy := 0.0
+			if be.Alive {
+				healthy = 1.0
+			}
+			ch <- prometheus.MustNewConstMetric(backendInFlightDesc, prometheus.GaugeValue, float64(be.InFlight), router.Name, be.Host)
+			ch <- prometheus.MustNewConstMetric(backendPoolSizeDesc, prometheus.GaugeValue, float64(be.PoolSize), router.Name, be.Host)
+			ch <- prometheus.MustNewConstMetric(backendMaxConnectionsDesc, prometheus.GaugeValue, float64(be.MaxConnections), router.Name, be.Host)
+			if be.ConcurrencyLimit > 0 {
+				ch <- prometheus.MustNewConstMetric(backendConcurrencyLimitDesc, prometheus.GaugeValue, float64(be.ConcurrencyLimit), router.Name, be.Host)
+			}
+			ch <- prometheus.MustNewConstMetric(backendHealthyDesc, prometheus.GaugeValue, healthy, router.Name, be.Host)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// generateTestLBLight creates an LBLight with a single router (/foo) pointing at backendURL.
+func generateTestLBLight(t *testing.T, backendURL string) *LBLight {
+	config := generateTestConfig("/foo")
+	config.BackendRouterConfigs[0].BackendConfigs[0].Host = backendURL
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+	return lbl
+}
+
+func scrapeMetrics(t *testing.T, lbl *LBLight) string {
+	res := httptest.NewRecorder()
+	lbl.MetricsHandler().ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, err := ioutil.ReadAll(res.Body)
+	assert.Nil(t, err, "Error not expected")
+	return string(body)
+}
+
+func TestMetricsRecordsProxiedRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+
+	lbl := generateTestLBLight(t, backend.URL)
+	for i := 0; i < 3; i++ {
+		res := httptest.NewRecorder()
+		lbl.handleRequestsAndRedirect(res, httptest.NewRequest(http.MethodGet, "/foo/bar", nil))
+		assert.Equal(t, http.StatusCreated, res.Code)
+	}
+
+	metrics := scrapeMetrics(t, lbl)
+	assert.Contains(t, metrics, fmt.Sprintf(`lblight_requests_total{backend="%s",code="2xx",router="/foo"} 3`, backend.URL))
+	assert.Contains(t, metrics, fmt.Sprintf(`lblight_request_duration_seconds_count{backend="%s",router="/foo"} 3`, backend.URL))
+	assert.Contains(t, metrics, fmt.Sprintf(`lblight_backend_pool_size{backend="%s",router="/foo"} 1`, backend.URL))
+	assert.Contains(t, metrics, fmt.Sprintf(`lblight_backend_healthy{backend="%s",router="/foo"} 1`, backend.URL))
+}
+
+func TestMetricsRecordsAbortedRequests(t *testing.T) {
+	backend := startTruncatingBackend()
+	defer backend.Close()
+
+	lbl := generateTestLBLight(t, backend.URL)
+	assert.NotNil(t, getAborted(lbl, "/foo"), "Expected truncated response")
+
+	// front server has closed, so the aborted handler has finished.
+	metrics := scrapeMetrics(t, lbl)
+	assert.Contains(t, metrics, fmt.Sprintf(`lblight_requests_total{backend="%s",code="2xx",router="/foo"} 1`, backend.URL))
+	assert.Contains(t, metrics, fmt.Sprintf(`lblight_request_duration_seconds_count{backend="%s",router="/foo"} 1`, backend.URL))
+}
+
+func TestMetricsRecordsRejections(t *testing.T) {
+	lbl := generateTestLBLight(t, "http://127.0.0.1:1")
+	ber, _ := lbl.GetBackendRouterByName("/foo")
+	be, _ := ber.GetBackend()
+
+	// use up the only connection so the next request is rejected.
+	be.SetMaxConnections(1)
+	_, err := be.GetBackendConnection()
+	assert.Nil(t, err, "Error not expected")
+
+	res := httptest.NewRecorder()
+	lbl.handleRequestsAndRedirect(res, httptest.NewRequest(http.MethodGet, "/foo", nil))
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+	assert.Contains(t, scrapeMetrics(t, lbl), `lblight_rejected_requests_total{code="429",router="/foo"} 1`)
+}
+
+func TestDuplicateBackendValidation(t *testing.T) {
+	config := generateTestConfig("/foo")
+	config.BackendRouterConfigs[0].BackendConfigs = append(config.BackendRouterConfigs[0].BackendConfigs, config.BackendRouterConfigs[0].BackendConfigs[0])
+	assert.NotNil(t, config.Validate(), "Expected error for backend configured twice in a router")
+
+	lbl := NewLBLight(4000, false)
+	assert.NotNil(t, lbl.Reload(config), "Expected reload to reject backend configured twice in a router")
+
+	// same backend in different routers is fine.
+	config = generateTestConfig("/foo", "/bar")
+	config.BackendRouterConfigs[1].BackendConfigs[0].Host = config.BackendRouterConfigs[0].BackendConfigs[0].Host
+	assert.Nil(t, config.Validate(), "Error not expected")
+}
@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// PathRewriteConfig replaces the parts of the path matching Match with Replace (which can use $1 etc).
+type PathRewriteConfig struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+// pathRewriter changes the path of requests going to a backend: StripPrefix is removed, then AddPrefix
+// added, then the regex rewrites applied in order.
+type pathRewriter struct {
+	stripPrefix string
+	addPrefix   string
+	rewrites    []pathRewrite
+}
+
+type pathRewrite struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+// newPathRewriter compiles the rewrite config for a router. Returns nil if the path isn't changed.
+func newPathRewriter(stripPrefix string, addPrefix string, rewrites []PathRewriteConfig) (*pathRewriter, error) {
+	if stripPrefix == "" && addPrefix == "" && len(rewrites) == 0 {
+		return nil, nil
+	}
+
+	for _, prefix := range []string{stripPrefix, addPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("StripPrefix and AddPrefix must start with /")
+		}
+	}
+
+	pr := pathRewriter{stripPrefix: strings.TrimSuffix(stripPrefix, "/"), addPrefix: strings.TrimSuffix(addPrefix, "/")}
+	for _, rewrite := range rewrites {
+		match, err := regexp.Compile(rewrite.Match)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid PathRewrites match %s : %s", rewrite.Match, err.Error())
+		}
+		pr.rewrites = append(pr.rewrites, pathRewrite{match: match, replace: rewrite.Replace})
+	}
+	return &pr, nil
+}
+
+// rewrite changes the path of u.
+func (pr *pathRewriter) rewrite(u *url.URL) {
+	path := u.EscapedPath()
+	path = addPathPrefix(pr.addPrefix, stripPathPrefix(pr.stripPrefix, path))
+	for _, rewrite := range pr.rewrites {
+		path = rewrite.match.ReplaceAllString(path, rewrite.replace)
+	}
+	setEscapedPath(u, path)
+}
+
+// rewriteLocation maps a Location header from the backend back to the path the client would use, by undoing
+// the prefix changes. Absolute URLs pointing at the backend are made relative, so the client stays on LBLight.
+// Regex rewrites can't be undone, so aren't.
+func (pr *pathRewriter) rewriteLocation(location string, backendURL *url.URL) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	if u.IsAbs() || u.Host != "" {
+		if !strings.EqualFold(u.Host, backendURL.Host) {
+			return location
+		}
+		u.Scheme = ""
+		u.Host = ""
+		u.User = nil
+	}
+
+	// relative paths (eg. "next") are relative to the client's path already.
+	path := u.EscapedPath()
+	if !strings.HasPrefix(path, "/") {
+		return u.String()
+	}
+
+	path = addPathPrefix(pr.stripPrefix, stripPathPrefix(pr.addPrefix, path))
+	setEscapedPath(u, path)
+	return u.String()
+}
+
+// stripPathPrefix removes prefix from path, if path is prefix or under it ("/orders" isn't stripped from
+// "/ordersx"). Stripping all of the path gives "".
+func stripPathPrefix(prefix string, path string) string {
+	if prefix == "" || len(path) < len(prefix) || !strings.EqualFold(path[:len(prefix)], prefix) {
+		return path
+	}
+	if len(path) > len(prefix) && path[len(prefix)] != '/' {
+		return path
+	}
+	return path[len(prefix):]
+}
+
+// addPathPrefix puts prefix in front of path, making sure the result is at least "/".
+func addPathPrefix(prefix string, path string) string {
+	path = prefix + path
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// setEscapedPath sets the path of u from its escaped form, keeping the encoding the client used.
+func setEscapedPath(u *url.URL, escaped string) {
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return
+	}
+	u.Path = path
+	u.RawPath = ""
+	if u.EscapedPath() != escaped {
+		u.RawPath = escaped
+	}
+}
+
+// isRedirect returns true if the response's Location header should be rewritten.
+func isRedirect(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusCreated || (resp.StatusCode >= 300 && resp.StatusCode < 400)
+}
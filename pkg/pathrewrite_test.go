@@ -0,0 +1,105 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestPathRewrite(t *testing.T) {
+	pr, err := newPathRewriter("/orders", "/api/v1/", []PathRewriteConfig{{Match: "^/api/v1/item/([0-9]+)$", Replace: "/api/v1/items/$1"}})
+	assert.Nil(t, err, "Error not expected")
+
+	tests := map[string]string{
+		"/orders":          "/api/v1",
+		"/orders/":         "/api/v1/",
+		"/orders/list":     "/api/v1/list",
+		"/ORDERS/list":     "/api/v1/list",
+		"/orders/item/42":  "/api/v1/items/42",
+		"/ordersx/list":    "/api/v1/ordersx/list",
+		"/orders/a%2Fb":    "/api/v1/a%2Fb",
+		"/orders/with%20s": "/api/v1/with%20s",
+	}
+	for in, expected := range tests {
+		u, _ := url.Parse(in)
+		pr.rewrite(u)
+		assert.Equal(t, expected, u.EscapedPath(), "Rewriting %s", in)
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	pr, err := newPathRewriter("/orders", "/api", nil)
+	assert.Nil(t, err, "Error not expected")
+	backendURL, _ := url.Parse("http://10.0.0.1:5000")
+
+	tests := map[string]string{
+		"/api/list?page=2":                "/orders/list?page=2",
+		"/api":                            "/orders",
+		"http://10.0.0.1:5000/api/item/1": "/orders/item/1",
+		"https://example.com/api/x":       "https://example.com/api/x",
+		"/other":                          "/orders/other",
+		"next":                            "next",
+	}
+	for in, expected := range tests {
+		assert.Equal(t, expected, pr.rewriteLocation(in, backendURL), "Rewriting %s", in)
+	}
+}
+
+func TestPathRewriteThroughProxy(t *testing.T) {
+	var receivedPath string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedPath = r.URL.Path
+		http.Redirect(w, r, "/created/1", http.StatusFound)
+	}))
+	defer backend.Close()
+
+	config := generateTestConfig("/orders")
+	config.BackendRouterConfigs[0].BackendConfigs[0].Host = backend.URL
+	config.BackendRouterConfigs[0].StripPrefix = "/orders"
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+
+	res := httptest.NewRecorder()
+	lbl.handleRequestsAndRedirect(res, httptest.NewRequest(http.MethodPost, "/orders/new", nil))
+	assert.Equal(t, http.StatusFound, res.Code)
+	assert.Equal(t, "/new", receivedPath)
+	assert.Equal(t, "/orders/created/1", res.Header().Get("Location"))
+}
+
+func TestPathRewriteOnRetry(t *testing.T) {
+	backend, received := newDroppingBackend(t)
+	defer backend.Close()
+
+	config := generateTestConfig("/foo")
+	config.BackendRouterConfigs[0].BackendConfigs[0].Host = backend.URL
+	config.BackendRouterConfigs[0].AddPrefix = "/api"
+	config.BackendRouterConfigs[0].PathRewrites = []PathRewriteConfig{{Match: "/bar$", Replace: "/bar/x"}}
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+
+	res := httptest.NewRecorder()
+	lbl.handleRequestsAndRedirect(res, httptest.NewRequest(http.MethodGet, "/foo/bar?a=1", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	requests := received()
+	assert.Equal(t, 2, len(requests), "Expected the request to be retried")
+	for _, r := range requests {
+		assert.Equal(t, "/api/foo/bar/x", r.URL.Path)
+		assert.Equal(t, "a=1", r.URL.RawQuery)
+	}
+}
+
+func TestPathRewriteValidation(t *testing.T) {
+	pr, err := newPathRewriter("", "", nil)
+	assert.Nil(t, err, "Error not expected")
+	assert.Nil(t, pr, "Expected no rewriter")
+
+	_, err = newPathRewriter("orders", "", nil)
+	assert.NotNil(t, err, "Expected error for prefix without /")
+	_, err = newPathRewriter("", "", []PathRewriteConfig{{Match: "(", Replace: ""}})
+	assert.NotNil(t, err, "Expected invalid regex error")
+}
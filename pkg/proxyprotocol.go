@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/pires/go-proxyproto"
+	"net"
+	"net/http"
+)
+
+// ProxyProtocolConfig configures accepting HAProxy PROXY protocol (v1 or v2) on the traffic listener,
+// so the real client address is known when LBLight is behind a TCP load balancer.
+type ProxyProtocolConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// IPs or CIDRs allowed to send a PROXY header. Connections from anywhere else that send one are rejected.
+	TrustedCIDRs []string `json:"trustedcidrs"`
+}
+
+// Validate checks the PROXY protocol config.
+func (c ProxyProtocolConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.TrustedCIDRs) == 0 {
+		return fmt.Errorf("ProxyProtocol trustedcidrs must be set when enabled")
+	}
+	_, err := parseTrustedProxies(c.TrustedCIDRs)
+	return err
+}
+
+// proxyProtocolListener wraps listener so connections from trusted sources can send a PROXY header.
+// The RemoteAddr of those connections (and so the requests on them) is the client address from the header.
+func proxyProtocolListener(listener net.Listener, trusted []*net.IPNet) net.Listener {
+	policy := func(upstream net.Addr) (proxyproto.Policy, error) {
+		if tcpAddr, ok := upstream.(*net.TCPAddr); ok {
+			for _, ipNet := range trusted {
+				if ipNet.Contains(tcpAddr.IP) {
+					return proxyproto.USE, nil
+				}
+			}
+		}
+		return proxyproto.REJECT, nil
+	}
+	return &proxyproto.Listener{Listener: listener, Policy: policy}
+}
+
+// dialWithProxyHeader connects to the backend and sends a PROXY protocol v2 header with the address of
+// the client making the request (taken from the request info in ctx).
+func dialWithProxyHeader(ctx context.Context, network string, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	header := proxyHeaderFromContext(ctx, conn)
+	_, err = header.WriteTo(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialTLSWithProxyHeader is dialWithProxyHeader for TLS backends. The PROXY header goes before the handshake.
+func dialTLSWithProxyHeader(ctx context.Context, network string, addr string) (net.Conn, error) {
+	conn, err := dialWithProxyHeader(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return clientTLS(conn, addr)
+}
+
+// proxyHeaderFromContext builds the PROXY header for a backend connection. Source is the client,
+// destination is the address the client connected to. If the request isn't known (shouldn't happen)
+// a LOCAL header is sent so the backend uses the connection's own addresses.
+func proxyHeaderFromContext(ctx context.Context, conn net.Conn) *proxyproto.Header {
+	info, ok := ctx.Value(RequestInfoID).(*requestInfo)
+	if !ok || info.clientAddr == nil {
+		return &proxyproto.Header{Version: 2, Command: proxyproto.LOCAL, TransportProtocol: proxyproto.UNSPEC}
+	}
+
+	dest := info.localAddr
+	if dest == nil {
+		dest = conn.LocalAddr()
+	}
+	return proxyproto.HeaderProxyFromAddrs(2, info.clientAddr, dest)
+}
+
+// tcpAddrFromRequest returns the client address of the request as a TCPAddr, nil if it can't be parsed.
+func tcpAddrFromRequest(req *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return addr
+}
+
+// localAddrFromRequest returns the address the client connected to, nil if unknown.
+func localAddrFromRequest(req *http.Request) net.Addr {
+	addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return nil
+	}
+	return addr
+}
@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pires/go-proxyproto"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startProxyProtocolServer serves HTTP on a PROXY protocol listener trusting trustedCIDR, and sends the
+// RemoteAddr of each request to remoteAddrs.
+func startProxyProtocolServer(t *testing.T, trustedCIDR string, remoteAddrs chan string) net.Listener {
+	trusted, err := parseTrustedProxies([]string{trustedCIDR})
+	assert.Nil(t, err, "Error not expected")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "Error not expected")
+	listener = proxyProtocolListener(listener, trusted)
+
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrs <- r.RemoteAddr
+	}))
+	return listener
+}
+
+// sendWithProxyHeader sends a GET with a PROXY v2 header claiming to be from 203.0.113.7:1234.
+func sendWithProxyHeader(t *testing.T, addr net.Addr) (*http.Response, error) {
+	conn, err := net.Dial("tcp", addr.String())
+	assert.Nil(t, err, "Error not expected")
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	source := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 1234}
+	_, err = proxyproto.HeaderProxyFromAddrs(2, source, addr).WriteTo(conn)
+	assert.Nil(t, err, "Error not expected")
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	return http.ReadResponse(bufio.NewReader(conn), nil)
+}
+
+func TestProxyProtocolListenerTrusted(t *testing.T) {
+	remoteAddrs := make(chan string, 1)
+	listener := startProxyProtocolServer(t, "127.0.0.0/8", remoteAddrs)
+	defer listener.Close()
+
+	res, err := sendWithProxyHeader(t, listener.Addr())
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "203.0.113.7:1234", <-remoteAddrs)
+}
+
+func TestProxyProtocolListenerUntrusted(t *testing.T) {
+	remoteAddrs := make(chan string, 1)
+	listener := startProxyProtocolServer(t, "10.0.0.0/8", remoteAddrs)
+	defer listener.Close()
+
+	// header is treated as part of the request, so it's a bad request.
+	res, err := sendWithProxyHeader(t, listener.Addr())
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, 0, len(remoteAddrs))
+}
+
+func TestProxyProtocolToBackend(t *testing.T) {
+	remoteAddrs := make(chan string, 2)
+	listener := startProxyProtocolServer(t, "127.0.0.0/8", remoteAddrs)
+	defer listener.Close()
+
+	config := generateTestConfig("/foo")
+	config.BackendRouterConfigs[0].BackendConfigs[0].Host = "http://" + listener.Addr().String()
+	config.BackendRouterConfigs[0].BackendConfigs[0].SendProxyProtocol = true
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+
+	// each request gets its own connection with that client's address.
+	for _, client := range []string{"198.51.100.9:5555", "198.51.100.10:6666"} {
+		req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		req.RemoteAddr = client
+		res := httptest.NewRecorder()
+		lbl.handleRequestsAndRedirect(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, client, <-remoteAddrs)
+	}
+}
+
+func TestProxyProtocolConfigValidation(t *testing.T) {
+	assert.Nil(t, ProxyProtocolConfig{}.Validate(), "Error not expected")
+	assert.NotNil(t, ProxyProtocolConfig{Enabled: true}.Validate(), "Expected missing trustedcidrs error")
+	assert.NotNil(t, ProxyProtocolConfig{Enabled: true, TrustedCIDRs: []string{"bad"}}.Validate(), "Expected invalid CIDR error")
+}
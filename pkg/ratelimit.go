@@ -0,0 +1,280 @@
+package pkg
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RateLimitKeyIP     string = "ip"
+	RateLimitKeyHeader string = "header:"
+	RateLimitKeyJWT    string = "jwt:"
+
+	// how often idle keys are cleared out.
+	rateLimitSweepInterval = time.Minute
+)
+
+// RateLimitConfig configures token bucket rate limiting for a router. Each key (client IP, API key etc)
+// gets its own bucket of Burst tokens, refilled at RequestsPerSecond. Requests with no token left get a 429.
+type RateLimitConfig struct {
+	// 0 disables rate limiting.
+	RequestsPerSecond float64 `json:"requestspersecond"`
+
+	// max requests in a burst, defaults to RequestsPerSecond (at least 1).
+	Burst int `json:"burst,omitempty"`
+
+	// with a shared RateLimitStore, the limit is RequestsPerSecond * WindowInSeconds requests in any
+	// window of this length. Defaults to 1 second.
+	WindowInSeconds int `json:"windowinseconds,omitempty"`
+
+	// what to limit on: "ip" (default), "header:<name>" (eg. header:X-API-Key) or "jwt:<claim>" (claim from the
+	// bearer token, eg. jwt:sub). The JWT is NOT verified, the claim is only used to tell clients apart.
+	// Requests without the header/claim are limited by IP.
+	Key string `json:"key,omitempty"`
+}
+
+// Enabled returns true if rate limiting is configured.
+func (c RateLimitConfig) Enabled() bool {
+	return c.RequestsPerSecond > 0
+}
+
+// Validate checks the rate limit config.
+func (c RateLimitConfig) Validate() error {
+	if c.RequestsPerSecond < 0 || c.Burst < 0 || c.WindowInSeconds < 0 {
+		return fmt.Errorf("RateLimit requestspersecond, burst and windowinseconds cannot be negative")
+	}
+
+	key := strings.ToLower(c.Key)
+	switch {
+	case key == "" || key == RateLimitKeyIP:
+	case strings.HasPrefix(key, RateLimitKeyHeader) && len(key) > len(RateLimitKeyHeader):
+	case strings.HasPrefix(key, RateLimitKeyJWT) && len(key) > len(RateLimitKeyJWT):
+	default:
+		return fmt.Errorf("Unknown RateLimit key %s", c.Key)
+	}
+	return nil
+}
+
+// GetBurst returns the bucket size.
+func (c RateLimitConfig) GetBurst() int {
+	if c.Burst > 0 {
+		return c.Burst
+	}
+	return int(math.Max(1, math.Ceil(c.RequestsPerSecond)))
+}
+
+// GetWindow returns the sliding window used with a shared store.
+func (c RateLimitConfig) GetWindow() time.Duration {
+	if c.WindowInSeconds == 0 {
+		return time.Second
+	}
+	return time.Duration(c.WindowInSeconds) * time.Second
+}
+
+// GetWindowLimit returns how many requests are allowed per window with a shared store.
+func (c RateLimitConfig) GetWindowLimit() int {
+	return int(math.Max(1, math.Ceil(c.RequestsPerSecond*c.GetWindow().Seconds())))
+}
+
+// rateLimitResult is the outcome of checking a request against the limit.
+type rateLimitResult struct {
+	allowed   bool
+	limit     int
+	remaining int
+
+	// until the bucket is full again.
+	reset time.Duration
+
+	// until the next request would be allowed. 0 if allowed.
+	retryAfter time.Duration
+}
+
+// tokenBucket is the state for a single key.
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// rateLimiter keeps a token bucket per key, in memory. If there is a shared store then that is used
+// instead, the buckets are only used while the store is unavailable.
+type rateLimiter struct {
+	config     RateLimitConfig
+	routerName string
+	burst      float64
+
+	// nil if limits are local.
+	store *rateLimitStore
+
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	mux       sync.Mutex
+}
+
+func newRateLimiter(config RateLimitConfig, routerName string, store *rateLimitStore) *rateLimiter {
+	rl := rateLimiter{config: config, routerName: routerName, burst: float64(config.GetBurst()), store: store}
+	rl.buckets = make(map[string]*tokenBucket)
+	rl.lastSweep = time.Now()
+	return &rl
+}
+
+// check counts the request against the shared store, or the local bucket if there's no store (or it's down).
+func (rl *rateLimiter) check(ctx context.Context, key string, now time.Time) rateLimitResult {
+	result, ok := rl.checkStore(ctx, key, now)
+	if ok {
+		return result
+	}
+	return rl.allow(key, now)
+}
+
+// allow takes a token from key's bucket, if there is one.
+func (rl *rateLimiter) allow(key string, now time.Time) rateLimitResult {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+
+	rl.sweep(now)
+
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: rl.burst, lastSeen: now}
+		rl.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(rl.burst, bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*rl.config.RequestsPerSecond)
+	bucket.lastSeen = now
+
+	result := rateLimitResult{limit: int(rl.burst)}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.allowed = true
+	} else {
+		result.retryAfter = rl.timeToFill(1 - bucket.tokens)
+	}
+	result.remaining = int(bucket.tokens)
+	result.reset = rl.timeToFill(rl.burst - bucket.tokens)
+	return result
+}
+
+// timeToFill returns how long it takes to add tokens to a bucket.
+func (rl *rateLimiter) timeToFill(tokens float64) time.Duration {
+	return time.Duration(tokens / rl.config.RequestsPerSecond * float64(time.Second))
+}
+
+// sweep removes buckets that would be full by now, since they're the same as a new bucket. Only
+// done every rateLimitSweepInterval.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	rl.lastSweep = now
+
+	for key, bucket := range rl.buckets {
+		if now.Sub(bucket.lastSeen) >= rl.timeToFill(rl.burst-bucket.tokens) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// rateLimitKey returns the key the request is limited on.
+func rateLimitKey(config RateLimitConfig, req *http.Request, clientIP string) string {
+	key := strings.ToLower(config.Key)
+	switch {
+	case strings.HasPrefix(key, RateLimitKeyHeader):
+		if val := req.Header.Get(config.Key[len(RateLimitKeyHeader):]); val != "" {
+			return "header:" + val
+		}
+	case strings.HasPrefix(key, RateLimitKeyJWT):
+		if val := jwtClaim(req, config.Key[len(RateLimitKeyJWT):]); val != "" {
+			return "jwt:" + val
+		}
+	}
+	return "ip:" + clientIP
+}
+
+// jwtClaim returns the claim from the bearer token in the Authorization header, "" if there isn't one.
+// The signature is not checked.
+func jwtClaim(req *http.Request, claim string) string {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+
+	parts := strings.Split(strings.TrimPrefix(auth, "Bearer "), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+
+	var claims map[string]interface{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return ""
+	}
+
+	switch val := claims[claim].(type) {
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	}
+	return ""
+}
+
+// setRateLimitHeaders adds the RateLimit-* headers (and Retry-After if rejected) to the response.
+func setRateLimitHeaders(header http.Header, result rateLimitResult) {
+	header.Set("RateLimit-Limit", strconv.Itoa(result.limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(result.remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.reset)))
+	if !result.allowed {
+		header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.retryAfter)))
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// checkRateLimit applies the router's rate limit to the request. If the request is over the limit then
+// a 429 is sent and false returned.
+func (l *LBLight) checkRateLimit(res http.ResponseWriter, req *http.Request, router *BackendRouter, info *requestInfo) bool {
+	if router.rateLimiter == nil {
+		return true
+	}
+
+	key := rateLimitKey(router.rateLimiter.config, req, info.clientIP(req))
+	result := router.rateLimiter.check(req.Context(), key, time.Now())
+	setRateLimitHeaders(res.Header(), result)
+	if result.allowed {
+		return true
+	}
+
+	requestLog(req).Warnf("Rate limit exceeded for %s on router %s", key, router.Name)
+	writeError(res, req, http.StatusTooManyRequests, "Too many requests")
+	l.metrics.observeRejection(router.Name, http.StatusTooManyRequests)
+	return false
+}
+
+// clientIP returns the IP of the client. If the request came through trusted proxies then it's the
+// address they reported in X-Forwarded-For.
+func (ri *requestInfo) clientIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if ri.forwarding == nil {
+		return ip
+	}
+	return ri.forwarding.clientIP(ip, req.Header.Values(xForwardedForHeader))
+}
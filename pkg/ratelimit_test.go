@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBucket(t *testing.T) {
+	rl := newRateLimiter(RateLimitConfig{RequestsPerSecond: 2, Burst: 3}, "test", nil)
+	now := time.Now()
+
+	for i := 2; i >= 0; i-- {
+		result := rl.allow("a", now)
+		assert.True(t, result.allowed, "Expected request to be allowed")
+		assert.Equal(t, 3, result.limit)
+		assert.Equal(t, i, result.remaining)
+	}
+
+	result := rl.allow("a", now)
+	assert.False(t, result.allowed, "Expected request to be limited")
+	assert.Equal(t, 500*time.Millisecond, result.retryAfter)
+	assert.Equal(t, 1500*time.Millisecond, result.reset)
+
+	// other keys have their own bucket.
+	assert.True(t, rl.allow("b", now).allowed, "Expected request to be allowed")
+
+	// refilled at 2 per second.
+	assert.True(t, rl.allow("a", now.Add(500*time.Millisecond)).allowed, "Expected request to be allowed")
+	assert.False(t, rl.allow("a", now.Add(500*time.Millisecond)).allowed, "Expected request to be limited")
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	rl := newRateLimiter(RateLimitConfig{RequestsPerSecond: 1, Burst: 100}, "test", nil)
+	now := time.Now()
+	rl.allow("idle", now)
+	rl.allow("busy", now)
+
+	// idle is full again after 1s so goes, busy drains its bucket and stays.
+	later := now.Add(rateLimitSweepInterval)
+	for i := 0; i < 100; i++ {
+		rl.allow("busy", later.Add(-time.Second))
+	}
+	rl.allow("other", later)
+
+	_, ok := rl.buckets["idle"]
+	assert.False(t, ok, "Expected idle key to be removed")
+	_, ok = rl.buckets["busy"]
+	assert.True(t, ok, "Expected busy key to be kept")
+}
+
+func TestRateLimitKey(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user1","org":42}`))
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.Header.Set("X-API-Key", "key1")
+	req.Header.Set("Authorization", "Bearer header."+payload+".sig")
+
+	assert.Equal(t, "ip:192.0.2.1", rateLimitKey(RateLimitConfig{}, req, "192.0.2.1"))
+	assert.Equal(t, "header:key1", rateLimitKey(RateLimitConfig{Key: "header:X-API-Key"}, req, "192.0.2.1"))
+	assert.Equal(t, "jwt:user1", rateLimitKey(RateLimitConfig{Key: "jwt:sub"}, req, "192.0.2.1"))
+	assert.Equal(t, "jwt:42", rateLimitKey(RateLimitConfig{Key: "jwt:org"}, req, "192.0.2.1"))
+
+	// falls back to IP if the header/claim is missing.
+	assert.Equal(t, "ip:192.0.2.1", rateLimitKey(RateLimitConfig{Key: "header:X-Other"}, req, "192.0.2.1"))
+	assert.Equal(t, "ip:192.0.2.1", rateLimitKey(RateLimitConfig{Key: "jwt:missing"}, req, "192.0.2.1"))
+}
+
+func TestForwarderClientIP(t *testing.T) {
+	f, err := newForwarder(ForwardingConfig{TrustedProxies: []string{"10.0.0.0/8"}})
+	assert.Nil(t, err, "Error not expected")
+
+	assert.Equal(t, "192.0.2.1", f.clientIP("192.0.2.1", []string{"1.2.3.4"}), "Untrusted peer can't set client IP")
+	assert.Equal(t, "1.2.3.4", f.clientIP("10.0.0.1", []string{"5.6.7.8, 1.2.3.4"}))
+	assert.Equal(t, "1.2.3.4", f.clientIP("10.0.0.1", []string{"5.6.7.8, 1.2.3.4", "10.0.0.2"}))
+	assert.Equal(t, "10.0.0.1", f.clientIP("10.0.0.1", nil))
+}
+
+func TestRateLimitedRouter(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	config := generateTestConfig("/foo")
+	config.BackendRouterConfigs[0].BackendConfigs[0].Host = backend.URL
+	config.BackendRouterConfigs[0].RateLimit = RateLimitConfig{RequestsPerSecond: 0.5, Burst: 2}
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+
+	send := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		req.RemoteAddr = remoteAddr
+		res := httptest.NewRecorder()
+		lbl.handleRequestsAndRedirect(res, req)
+		return res
+	}
+
+	res := send("192.0.2.1:1000")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "2", res.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", res.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "2", res.Header().Get("RateLimit-Reset"))
+
+	assert.Equal(t, http.StatusOK, send("192.0.2.1:1001").Code)
+	res = send("192.0.2.1:1002")
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+	assert.Equal(t, "2", res.Header().Get("Retry-After"))
+	assert.Equal(t, "0", res.Header().Get("RateLimit-Remaining"))
+
+	// another client isn't affected.
+	assert.Equal(t, http.StatusOK, send("192.0.2.2:1000").Code)
+
+	// reloading with the same limit keeps the buckets.
+	err = lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, http.StatusTooManyRequests, send("192.0.2.1:1003").Code)
+
+	// changing the limit starts again.
+	config.BackendRouterConfigs[0].RateLimit.Burst = 3
+	err = lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+	assert.Equal(t, http.StatusOK, send("192.0.2.1:1004").Code)
+}
+
+func TestRateLimitConfigValidation(t *testing.T) {
+	assert.Nil(t, RateLimitConfig{}.Validate(), "Error not expected")
+	assert.Nil(t, RateLimitConfig{RequestsPerSecond: 1, Key: "header:X-API-Key"}.Validate(), "Error not expected")
+	assert.Nil(t, RateLimitConfig{RequestsPerSecond: 1, Key: "jwt:sub"}.Validate(), "Error not expected")
+	assert.NotNil(t, RateLimitConfig{RequestsPerSecond: -1}.Validate(), "Expected negative rate error")
+	assert.NotNil(t, RateLimitConfig{RequestsPerSecond: 1, Key: "header:"}.Validate(), "Expected missing header name error")
+	assert.NotNil(t, RateLimitConfig{RequestsPerSecond: 1, Key: "cookie"}.Validate(), "Expected unknown key error")
+	assert.Equal(t, 1, RateLimitConfig{RequestsPerSecond: 0.5}.GetBurst())
+	assert.Equal(t, 3, RateLimitConfig{RequestsPerSecond: 2.5}.GetBurst())
+}
@@ -0,0 +1,230 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRateLimitStoreKeyPrefix = "lblight:ratelimit:"
+	DefaultRateLimitStoreTimeout   = 100 * time.Millisecond
+
+	// how long to use local limits for after the store fails, before trying it again.
+	rateLimitStoreRetryInterval = 5 * time.Second
+)
+
+// RateLimitStoreConfig configures a store shared by several LBLight instances, so rate limits apply across
+// all of them instead of per instance. Anything speaking the Redis protocol can be used.
+type RateLimitStoreConfig struct {
+	// host:port of the store. Empty means limits are local to each instance.
+	Address  string `json:"address,omitempty"`
+	Password string `json:"password,omitempty"`
+	DB       int    `json:"db,omitempty"`
+
+	// prefix for all keys, defaults to DefaultRateLimitStoreKeyPrefix.
+	KeyPrefix string `json:"keyprefix,omitempty"`
+
+	// how long to wait for the store before falling back to local limits. Defaults to 100ms.
+	TimeoutInMilliseconds int `json:"timeoutinmilliseconds,omitempty"`
+}
+
+// Enabled returns true if a shared store is configured.
+func (c RateLimitStoreConfig) Enabled() bool {
+	return c.Address != ""
+}
+
+// Validate checks the store config.
+func (c RateLimitStoreConfig) Validate() error {
+	if c.DB < 0 || c.TimeoutInMilliseconds < 0 {
+		return fmt.Errorf("RateLimitStore db and timeoutinmilliseconds cannot be negative")
+	}
+	return nil
+}
+
+// GetKeyPrefix returns the configured key prefix, or the default if not set.
+func (c RateLimitStoreConfig) GetKeyPrefix() string {
+	if c.KeyPrefix == "" {
+		return DefaultRateLimitStoreKeyPrefix
+	}
+	return c.KeyPrefix
+}
+
+// GetTimeout returns the configured timeout, or the default if not set.
+func (c RateLimitStoreConfig) GetTimeout() time.Duration {
+	if c.TimeoutInMilliseconds == 0 {
+		return DefaultRateLimitStoreTimeout
+	}
+	return time.Duration(c.TimeoutInMilliseconds) * time.Millisecond
+}
+
+// slidingWindowScript counts a request against a sliding window, approximated from the counts of the current
+// and previous fixed windows (KEYS[1] and KEYS[2]). The previous count is weighted by how much of the previous
+// window is still inside the sliding window (ARGV[2]). Only counts the request if it's under the limit (ARGV[1]).
+// Returns whether the request was allowed, and the current and previous counts.
+var slidingWindowScript = redis.NewScript(`
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+local previous = tonumber(redis.call('GET', KEYS[2]) or '0')
+local limit = tonumber(ARGV[1])
+local weight = tonumber(ARGV[2])
+if previous * weight + current + 1 > limit then
+  return {0, current, previous}
+end
+redis.call('INCR', KEYS[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return {1, current + 1, previous}
+`)
+
+// rateLimitStore keeps sliding window counts in a shared Redis-protocol store.
+type rateLimitStore struct {
+	config RateLimitStoreConfig
+	client *redis.Client
+
+	// while the store is failing, local limits are used until retryAt.
+	failing bool
+	retryAt time.Time
+	mux     sync.Mutex
+}
+
+func newRateLimitStore(config RateLimitStoreConfig) *rateLimitStore {
+	store := rateLimitStore{config: config}
+	store.client = redis.NewClient(&redis.Options{
+		Addr:         config.Address,
+		Password:     config.Password,
+		DB:           config.DB,
+		DialTimeout:  config.GetTimeout(),
+		ReadTimeout:  config.GetTimeout(),
+		WriteTimeout: config.GetTimeout(),
+
+		// fall back to local limits rather than retrying.
+		MaxRetries: -1,
+	})
+	return &store
+}
+
+// Close closes the connections to the store.
+func (s *rateLimitStore) Close() error {
+	return s.client.Close()
+}
+
+// available returns false if the store failed recently and shouldn't be tried yet.
+func (s *rateLimitStore) available(now time.Time) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return !s.failing || !now.Before(s.retryAt)
+}
+
+// recordResult logs when the store stops or starts working, rather than on every request.
+func (s *rateLimitStore) recordResult(err error, now time.Time) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if err != nil {
+		if !s.failing {
+			log.Warnf("Rate limit store %s unavailable, using local limits : %s", s.config.Address, err.Error())
+		}
+		s.failing = true
+		s.retryAt = now.Add(rateLimitStoreRetryInterval)
+		return
+	}
+	if s.failing {
+		log.Infof("Rate limit store %s available again", s.config.Address)
+	}
+	s.failing = false
+}
+
+// allow counts a request for key against limit requests per window.
+func (s *rateLimitStore) allow(ctx context.Context, key string, limit int, window time.Duration, now time.Time) (rateLimitResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.GetTimeout())
+	defer cancel()
+
+	index := now.UnixNano() / int64(window)
+	windowStart := time.Unix(0, index*int64(window))
+	elapsed := now.Sub(windowStart)
+	weight := 1 - float64(elapsed)/float64(window)
+
+	// hash tag keeps both windows on the same node in a cluster.
+	base := fmt.Sprintf("%s{%s}:", s.config.GetKeyPrefix(), key)
+	keys := []string{base + strconv.FormatInt(index, 10), base + strconv.FormatInt(index-1, 10)}
+
+	// kept for two windows, since the next window uses it as the previous count.
+	ttl := (2 * window).Milliseconds()
+	res, err := slidingWindowScript.Run(ctx, s.client, keys, limit, strconv.FormatFloat(weight, 'f', 6, 64), ttl).Int64Slice()
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	if len(res) != 3 {
+		return rateLimitResult{}, fmt.Errorf("Unexpected rate limit store response %v", res)
+	}
+
+	current, previous := float64(res[1]), float64(res[2])
+	count := previous*weight + current
+	result := rateLimitResult{allowed: res[0] == 1, limit: limit}
+	result.remaining = int(math.Max(0, math.Floor(float64(limit)-count)))
+
+	// the current window's count only drops once it becomes the previous window, so everything has
+	// gone after the rest of this window plus the next one.
+	result.reset = window - elapsed
+	if current > 0 {
+		result.reset += window
+	}
+
+	if !result.allowed {
+		result.retryAfter = slidingWindowRetryAfter(count-float64(limit)+1, previous, window, elapsed)
+	}
+	return result, nil
+}
+
+// slidingWindowRetryAfter estimates how long until the count drops by excess, as the previous window slides out.
+// If that isn't enough, it's when the next window starts.
+func slidingWindowRetryAfter(excess float64, previous float64, window time.Duration, elapsed time.Duration) time.Duration {
+	if previous > 0 {
+		wait := time.Duration(excess / previous * float64(window))
+		if wait < window-elapsed {
+			return wait
+		}
+	}
+	return window - elapsed
+}
+
+// checkStore counts the request against the shared store, if there is one. Returns false if there is no
+// store or it isn't working, in which case the local limit should be used.
+func (rl *rateLimiter) checkStore(ctx context.Context, key string, now time.Time) (rateLimitResult, bool) {
+	if rl.store == nil || !rl.store.available(now) {
+		return rateLimitResult{}, false
+	}
+
+	result, err := rl.store.allow(ctx, rl.storeKey(key), rl.config.GetWindowLimit(), rl.config.GetWindow(), now)
+
+	// client went away or the store was replaced by a reload, not the store's fault.
+	if ctx.Err() != nil || err == redis.ErrClosed {
+		return rateLimitResult{}, false
+	}
+	rl.store.recordResult(err, now)
+	if err != nil {
+		return rateLimitResult{}, false
+	}
+	return result, true
+}
+
+// storeKey includes the router, so routers sharing a store don't share limits.
+func (rl *rateLimiter) storeKey(key string) string {
+	return rl.routerName + ":" + key
+}
+
+// getRateLimitStore returns the store for config, reusing current if the config hasn't changed. nil if no
+// store is configured.
+func getRateLimitStore(config RateLimitStoreConfig, current *rateLimitStore) *rateLimitStore {
+	if !config.Enabled() {
+		return nil
+	}
+	if current != nil && current.config == config {
+		return current
+	}
+	return newRateLimitStore(config)
+}
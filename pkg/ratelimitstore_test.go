@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// windowTime returns a time elapsed into a window, so tests don't depend on when they run.
+func windowTime(window time.Duration, index int64, elapsed time.Duration) time.Time {
+	return time.Unix(0, index*int64(window)).Add(elapsed)
+}
+
+func TestRateLimitStoreSlidingWindow(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store := newRateLimitStore(RateLimitStoreConfig{Address: mr.Addr()})
+	defer store.Close()
+	ctx := context.Background()
+
+	// 4 requests at the end of one window.
+	start := windowTime(time.Second, 1000, 900*time.Millisecond)
+	for i := 3; i >= 0; i-- {
+		result, err := store.allow(ctx, "a", 4, time.Second, start)
+		assert.Nil(t, err, "Error not expected")
+		assert.True(t, result.allowed, "Expected request to be allowed")
+		assert.Equal(t, i, result.remaining)
+	}
+	result, err := store.allow(ctx, "a", 4, time.Second, start)
+	assert.Nil(t, err, "Error not expected")
+	assert.False(t, result.allowed, "Expected request to be limited")
+	assert.Equal(t, 100*time.Millisecond, result.retryAfter)
+
+	// early in the next window most of the previous window still counts.
+	result, err = store.allow(ctx, "a", 4, time.Second, windowTime(time.Second, 1001, 100*time.Millisecond))
+	assert.Nil(t, err, "Error not expected")
+	assert.False(t, result.allowed, "Expected request to be limited")
+	assert.Equal(t, 150*time.Millisecond, result.retryAfter)
+
+	// half way through, half of it does.
+	for i := 0; i < 2; i++ {
+		result, err = store.allow(ctx, "a", 4, time.Second, windowTime(time.Second, 1001, 500*time.Millisecond))
+		assert.Nil(t, err, "Error not expected")
+		assert.True(t, result.allowed, "Expected request to be allowed")
+	}
+	result, err = store.allow(ctx, "a", 4, time.Second, windowTime(time.Second, 1001, 500*time.Millisecond))
+	assert.Nil(t, err, "Error not expected")
+	assert.False(t, result.allowed, "Expected request to be limited")
+
+	// other keys have their own counts.
+	result, err = store.allow(ctx, "b", 4, time.Second, start)
+	assert.Nil(t, err, "Error not expected")
+	assert.True(t, result.allowed, "Expected request to be allowed")
+}
+
+func TestRateLimitStoreSharedBetweenInstances(t *testing.T) {
+	mr := miniredis.RunT(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	config := generateTestConfig("/foo")
+	config.BackendRouterConfigs[0].BackendConfigs[0].Host = backend.URL
+	config.BackendRouterConfigs[0].RateLimit = RateLimitConfig{RequestsPerSecond: 1, Burst: 10, WindowInSeconds: 60}
+	config.RateLimitStore = RateLimitStoreConfig{Address: mr.Addr()}
+
+	var instances []*LBLight
+	for i := 0; i < 2; i++ {
+		lbl := NewLBLight(4000, false)
+		err := lbl.Reload(config)
+		assert.Nil(t, err, "Error not expected")
+		instances = append(instances, lbl)
+	}
+
+	// 60 per minute between both instances, not each.
+	allowed := 0
+	for i := 0; i < 80; i++ {
+		res := httptest.NewRecorder()
+		instances[i%2].handleRequestsAndRedirect(res, httptest.NewRequest(http.MethodGet, "/foo", nil))
+		if res.Code == http.StatusOK {
+			allowed++
+		} else {
+			assert.Equal(t, http.StatusTooManyRequests, res.Code)
+			assert.NotEqual(t, "", res.Header().Get("Retry-After"), "Expected Retry-After")
+		}
+	}
+	assert.True(t, allowed <= 60, "Expected at most 60 requests allowed, got %d", allowed)
+	assert.True(t, allowed >= 59, "Expected about 60 requests allowed, got %d", allowed)
+}
+
+func TestRateLimitStoreFallback(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rl := newRateLimiter(RateLimitConfig{RequestsPerSecond: 1, Burst: 2, WindowInSeconds: 60}, "test", newRateLimitStore(RateLimitStoreConfig{Address: mr.Addr()}))
+	defer rl.store.Close()
+	ctx := context.Background()
+	now := time.Now()
+
+	// store allows 60 a minute.
+	for i := 0; i < 3; i++ {
+		assert.True(t, rl.check(ctx, "a", now).allowed, "Expected request to be allowed")
+	}
+
+	// local bucket (burst 2) is used when the store is down.
+	mr.Close()
+	assert.True(t, rl.check(ctx, "b", now).allowed, "Expected request to be allowed")
+	assert.True(t, rl.store.failing, "Expected store to be marked failing")
+	assert.True(t, rl.check(ctx, "b", now).allowed, "Expected request to be allowed")
+	assert.False(t, rl.check(ctx, "b", now).allowed, "Expected request to be limited")
+
+	// tried again after the retry interval.
+	assert.Nil(t, mr.Restart(), "Error not expected")
+	assert.True(t, rl.check(ctx, "c", now.Add(rateLimitStoreRetryInterval)).allowed, "Expected request to be allowed")
+	assert.False(t, rl.store.failing, "Expected store to be working again")
+}
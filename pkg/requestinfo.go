@@ -0,0 +1,254 @@
+package pkg
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// RequestIDHeader carries the request ID to the backend and back to the client.
+	RequestIDHeader string = "X-Request-ID"
+
+	// incoming request IDs longer than this are replaced.
+	maxRequestIDLength = 128
+)
+
+// requestInfo tracks a single request as it passes through LBLight. It is stored in the request
+// context so the ReverseProxy hooks (ErrorHandler etc), which only get the request, can get to it.
+type requestInfo struct {
+	startTime time.Time
+
+	// ID used to correlate log entries for the request, in LBLight and the backends.
+	requestID string
+
+	// when the request was first sent to a backend and how long until the backend responded
+	// (response headers received, including any retries).
+	upstreamStart   time.Time
+	upstreamLatency time.Duration
+
+	// router and backend handling the request. nil until selected.
+	router  *BackendRouter
+	backend *Backend
+
+	// number of retries made against the backend.
+	retries int
+
+	// request body, if the router limits its size.
+	body *limitedBody
+
+	// sets the forwarding headers on the request sent to the backend.
+	forwarding *forwarder
+
+	// what the client sent, saved before the request is changed for the backend.
+	inbound inboundRequest
+
+	// global error pages, nil if none configured.
+	errorPages *errorPages
+
+	// client address and the address it connected to. Used for the PROXY header sent to backends.
+	clientAddr net.Addr
+	localAddr  net.Addr
+
+	metrics *metrics
+}
+
+// inboundRequest is the parts of the client's request the request to the backend is built from. The Director
+// changes the request and runs again on each retry, so these are saved before it first runs.
+type inboundRequest struct {
+	host     string
+	proto    string
+	remoteIP string
+
+	// URL and headers the client sent, before any path rewriting or header rules.
+	url    *url.URL
+	header http.Header
+
+	// forwarding headers (X-Forwarded-*, Forwarded) the client sent.
+	forwardingHeaders http.Header
+}
+
+// newInboundRequest saves the parts of req needed later.
+func newInboundRequest(req *http.Request) inboundRequest {
+	u := *req.URL
+	in := inboundRequest{host: req.Host, proto: "http", url: &u, header: req.Header.Clone(), forwardingHeaders: make(http.Header)}
+	if req.TLS != nil {
+		in.proto = "https"
+	}
+
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	in.remoteIP = ip
+
+	for _, header := range forwardingHeaders {
+		if values, ok := req.Header[header]; ok {
+			in.forwardingHeaders[header] = append([]string(nil), values...)
+		}
+	}
+	return in
+}
+
+// getRequestInfo returns the requestInfo for the request, or nil if there isn't one.
+func getRequestInfo(r *http.Request) *requestInfo {
+	if info, ok := r.Context().Value(RequestInfoID).(*requestInfo); ok {
+		return info
+	}
+	return nil
+}
+
+// requestIDFromRequest returns the X-Request-ID sent by the client, or a new random ID if the client
+// didn't send a usable one.
+func requestIDFromRequest(req *http.Request) string {
+	id := req.Header.Get(RequestIDHeader)
+	if isValidRequestID(id) {
+		return id
+	}
+	return generateRequestID()
+}
+
+// isValidRequestID checks the ID is non-empty, not too long and printable ASCII, so it's safe
+// to put in log lines and headers.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// generateRequestID returns a random 128 bit ID as hex.
+func generateRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		// crypto/rand shouldn't fail, but fall back on the time rather than have no ID.
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestLog returns a log entry with the request ID of the request attached, so every line
+// logged for the request can be correlated.
+func requestLog(r *http.Request) *log.Entry {
+	if info := getRequestInfo(r); info != nil {
+		return log.WithField("request_id", info.requestID)
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// routerName returns the name of the router handling the request, or "" if none selected.
+func (ri *requestInfo) routerName() string {
+	if ri.router == nil {
+		return ""
+	}
+	return ri.router.Name
+}
+
+// backendHost returns the host of the backend handling the request, or "" if none selected.
+func (ri *requestInfo) backendHost() string {
+	if ri.backend == nil {
+		return ""
+	}
+	return ri.backend.Host
+}
+
+// getUpstreamLatency returns how long the backend took to respond. If the backend never responded
+// then it's the time spent trying.
+func (ri *requestInfo) getUpstreamLatency() time.Duration {
+	if ri.upstreamStart.IsZero() {
+		return 0
+	}
+	if ri.upstreamLatency == 0 {
+		return time.Since(ri.upstreamStart)
+	}
+	return ri.upstreamLatency
+}
+
+// countingReader counts the bytes read from the request body.
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.bytes += int64(n)
+	return n, err
+}
+
+// responseRecorder wraps the ResponseWriter so the status code and bytes sent to the client can be recorded.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w}
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+// Bytes returns the number of body bytes written.
+func (rr *responseRecorder) Bytes() int64 {
+	return rr.bytes
+}
+
+// Status returns the status code sent, 200 if nothing has been written (which is what net/http will send).
+func (rr *responseRecorder) Status() int {
+	if rr.status == 0 {
+		return http.StatusOK
+	}
+	return rr.status
+}
+
+// Flush is needed for streaming responses.
+func (rr *responseRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack is needed for websockets/upgraded connections.
+func (rr *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("ResponseWriter does not support hijacking")
+	}
+	if rr.status == 0 {
+		rr.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// Unwrap lets http.ResponseController get to the original ResponseWriter.
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
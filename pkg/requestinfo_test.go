@@ -0,0 +1,71 @@
+package pkg
+
+import (
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDPassedThrough(t *testing.T) {
+	var backendID string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendID = r.Header.Get(RequestIDHeader)
+		w.Header().Set(RequestIDHeader, backendID)
+	}))
+	defer backend.Close()
+
+	lbl := generateTestLBLight(t, backend.URL)
+	req := httptest.NewRequest(http.MethodGet, "/foo/bar", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	res := httptest.NewRecorder()
+	lbl.handleRequestsAndRedirect(res, req)
+
+	assert.Equal(t, "abc-123", backendID)
+	assert.Equal(t, []string{"abc-123"}, res.Header().Values(RequestIDHeader))
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	var backendID string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendID = r.Header.Get(RequestIDHeader)
+	}))
+	defer backend.Close()
+
+	lbl := generateTestLBLight(t, backend.URL)
+	for _, id := range []string{"", "has space", strings.Repeat("a", maxRequestIDLength+1)} {
+		req := httptest.NewRequest(http.MethodGet, "/foo/bar", nil)
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		res := httptest.NewRecorder()
+		lbl.handleRequestsAndRedirect(res, req)
+
+		assert.Equal(t, 32, len(backendID), "Expected generated ID")
+		assert.NotEqual(t, id, backendID)
+		assert.Equal(t, backendID, res.Header().Get(RequestIDHeader))
+	}
+}
+
+func TestRequestIDInLogs(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	// nothing listening so the request is retried then fails.
+	lbl := generateTestLBLight(t, "http://127.0.0.1:1")
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	res := httptest.NewRecorder()
+	lbl.handleRequestsAndRedirect(res, req)
+
+	assert.Equal(t, "abc-123", res.Header().Get(RequestIDHeader))
+	assert.True(t, len(hook.AllEntries()) > RetryAttempts, "Expected retry and failure log entries")
+	for _, entry := range hook.AllEntries() {
+		if strings.HasPrefix(entry.Message, "healthcheck") {
+			continue
+		}
+		assert.Equal(t, "abc-123", entry.Data["request_id"], entry.Message)
+	}
+}
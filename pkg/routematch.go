@@ -0,0 +1,235 @@
+package pkg
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RouteMatchConfig matches requests on more than the path/host. Every condition that is set must match.
+// AcceptedPaths, AcceptedHosts and AcceptedHeaders on the router also have to match if they're set.
+type RouteMatchConfig struct {
+	// HTTP methods, eg. GET, POST. Any method if empty.
+	Methods []string `json:"methods,omitempty"`
+
+	// regular expression the path has to match.
+	PathRegex string `json:"pathregex,omitempty"`
+
+	// query parameters and headers that have to be present, or have a particular value.
+	Query   []ParamMatchConfig `json:"query,omitempty"`
+	Headers []ParamMatchConfig `json:"headers,omitempty"`
+
+	// IPs/CIDRs the client has to be in.
+	ClientCIDRs []string `json:"clientcidrs,omitempty"`
+}
+
+// ParamMatchConfig matches a query parameter or header. With no Value or Regex it only has to be present.
+type ParamMatchConfig struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+	Regex string `json:"regex,omitempty"`
+}
+
+// Enabled returns true if any condition is set.
+func (c RouteMatchConfig) Enabled() bool {
+	return len(c.Methods) > 0 || c.PathRegex != "" || len(c.Query) > 0 || len(c.Headers) > 0 || len(c.ClientCIDRs) > 0
+}
+
+// Validate checks the match config.
+func (c RouteMatchConfig) Validate() error {
+	_, err := newRouteMatcher(c)
+	return err
+}
+
+// routeMatcher is the compiled RouteMatchConfig.
+type routeMatcher struct {
+	methods     map[string]bool
+	pathRegex   *regexp.Regexp
+	query       []paramMatcher
+	headers     []paramMatcher
+	clientCIDRs []*net.IPNet
+}
+
+type paramMatcher struct {
+	name  string
+	value string
+	regex *regexp.Regexp
+}
+
+func newRouteMatcher(config RouteMatchConfig) (*routeMatcher, error) {
+	rm := routeMatcher{}
+	if len(config.Methods) > 0 {
+		rm.methods = make(map[string]bool)
+		for _, method := range config.Methods {
+			rm.methods[strings.ToUpper(method)] = true
+		}
+	}
+
+	if config.PathRegex != "" {
+		pathRegex, err := regexp.Compile(config.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Match pathregex %s : %s", config.PathRegex, err.Error())
+		}
+		rm.pathRegex = pathRegex
+	}
+
+	var err error
+	rm.query, err = compileParamMatchers(config.Query, "query")
+	if err != nil {
+		return nil, err
+	}
+	rm.headers, err = compileParamMatchers(config.Headers, "header")
+	if err != nil {
+		return nil, err
+	}
+
+	rm.clientCIDRs, err = parseTrustedProxies(config.ClientCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Match clientcidrs : %s", err.Error())
+	}
+	return &rm, nil
+}
+
+func compileParamMatchers(params []ParamMatchConfig, kind string) ([]paramMatcher, error) {
+	var matchers []paramMatcher
+	for _, param := range params {
+		if param.Name == "" {
+			return nil, fmt.Errorf("Match %s has no name", kind)
+		}
+		if param.Value != "" && param.Regex != "" {
+			return nil, fmt.Errorf("Match %s %s can't have both value and regex", kind, param.Name)
+		}
+
+		pm := paramMatcher{name: param.Name, value: param.Value}
+		if kind == "header" {
+			pm.name = http.CanonicalHeaderKey(param.Name)
+		}
+		if param.Regex != "" {
+			regex, err := regexp.Compile(param.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid Match %s %s regex %s : %s", kind, param.Name, param.Regex, err.Error())
+			}
+			pm.regex = regex
+		}
+		matchers = append(matchers, pm)
+	}
+	return matchers, nil
+}
+
+// matches returns true if any of values satisfies the matcher.
+func (pm paramMatcher) matches(values []string, present bool) bool {
+	if !present {
+		return false
+	}
+	if pm.value == "" && pm.regex == nil {
+		return true
+	}
+	for _, val := range values {
+		if pm.regex != nil && pm.regex.MatchString(val) {
+			return true
+		}
+		if pm.regex == nil && val == pm.value {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if the request meets every condition.
+func (rm *routeMatcher) matches(req *http.Request, clientIP string) bool {
+	if rm.methods != nil && !rm.methods[req.Method] {
+		return false
+	}
+	if rm.pathRegex != nil && !rm.pathRegex.MatchString(req.URL.Path) {
+		return false
+	}
+
+	if len(rm.query) > 0 {
+		query := req.URL.Query()
+		for _, pm := range rm.query {
+			values, ok := query[pm.name]
+			if !pm.matches(values, ok) {
+				return false
+			}
+		}
+	}
+
+	for _, pm := range rm.headers {
+		values, ok := req.Header[pm.name]
+		if !pm.matches(values, ok) {
+			return false
+		}
+	}
+
+	if len(rm.clientCIDRs) > 0 {
+		ip := net.ParseIP(clientIP)
+		for _, cidr := range rm.clientCIDRs {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// matchesRequest checks a router with a Match against the request. Its AcceptedHosts, AcceptedPaths and
+// AcceptedHeaders have to match as well, if set.
+func (ber *BackendRouter) matchesRequest(req *http.Request, clientIP string) bool {
+	if len(ber.acceptedHosts) > 0 {
+		found := false
+		for _, candidate := range hostCandidates(normaliseHost(req.Host)) {
+			if ber.acceptedHosts[candidate] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(ber.acceptedPaths) > 0 {
+		lowerPath := strings.ToLower(req.URL.Path)
+		found := false
+		for path := range ber.acceptedPaths {
+			if strings.HasPrefix(lowerPath, strings.ToLower(path)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for header, val := range ber.acceptedHeaders {
+		if req.Header.Get(header) != val {
+			return false
+		}
+	}
+
+	return ber.matcher.matches(req, clientIP)
+}
+
+// addMatchRouter adds a router with a Match to the list checked before the path/host lookup, keeping the
+// list in priority order. Routers with the same priority are checked in the order they were added.
+func (rt *routingTable) addMatchRouter(ber *BackendRouter) {
+	rt.matchRouters = append(rt.matchRouters, ber)
+	sort.SliceStable(rt.matchRouters, func(i, j int) bool {
+		return rt.matchRouters[i].Priority > rt.matchRouters[j].Priority
+	})
+}
+
+// getMatchRouter returns the highest priority router with a Match that accepts the request, nil if none do.
+func (rt *routingTable) getMatchRouter(req *http.Request, clientIP string) *BackendRouter {
+	for _, ber := range rt.matchRouters {
+		if ber.matchesRequest(req, clientIP) {
+			return ber
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouteMatcher(t *testing.T) {
+	matcher, err := newRouteMatcher(RouteMatchConfig{
+		Methods:     []string{"get", "HEAD"},
+		PathRegex:   "^/items/[0-9]+$",
+		Query:       []ParamMatchConfig{{Name: "debug"}, {Name: "v", Regex: "^2\\."}},
+		Headers:     []ParamMatchConfig{{Name: "x-tenant", Value: "acme"}},
+		ClientCIDRs: []string{"10.0.0.0/8", "192.0.2.1"},
+	})
+	assert.Nil(t, err, "Error not expected")
+
+	newReq := func(method string, target string) *http.Request {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("X-Tenant", "acme")
+		return req
+	}
+
+	assert.True(t, matcher.matches(newReq(http.MethodGet, "/items/1?debug&v=2.1"), "192.0.2.1"), "Expected match")
+	assert.True(t, matcher.matches(newReq(http.MethodHead, "/items/1?debug=1&v=1&v=2.0"), "10.1.2.3"), "Expected match on any query value")
+	assert.False(t, matcher.matches(newReq(http.MethodPost, "/items/1?debug&v=2.1"), "192.0.2.1"), "Expected method mismatch")
+	assert.False(t, matcher.matches(newReq(http.MethodGet, "/items/abc?debug&v=2.1"), "192.0.2.1"), "Expected path mismatch")
+	assert.False(t, matcher.matches(newReq(http.MethodGet, "/items/1?v=2.1"), "192.0.2.1"), "Expected missing query parameter")
+	assert.False(t, matcher.matches(newReq(http.MethodGet, "/items/1?debug&v=3.0"), "192.0.2.1"), "Expected query regex mismatch")
+	assert.False(t, matcher.matches(newReq(http.MethodGet, "/items/1?debug&v=2.1"), "192.0.2.2"), "Expected client mismatch")
+
+	req := newReq(http.MethodGet, "/items/1?debug&v=2.1")
+	req.Header.Set("X-Tenant", "other")
+	assert.False(t, matcher.matches(req, "192.0.2.1"), "Expected header mismatch")
+}
+
+func TestRouteMatchPriority(t *testing.T) {
+	config := generateTestConfig("/api")
+	config.BackendRouterConfigs = append(config.BackendRouterConfigs,
+		BackendRouterConfig{Name: "writes", AcceptedPaths: []string{"/api"}, Match: RouteMatchConfig{Methods: []string{"POST", "PUT"}}},
+		BackendRouterConfig{Name: "canary", Priority: 10, Match: RouteMatchConfig{Headers: []ParamMatchConfig{{Name: "X-Canary"}}}},
+		BackendRouterConfig{Name: "internal", Priority: 10, Match: RouteMatchConfig{ClientCIDRs: []string{"192.0.2.0/24"}}},
+	)
+	lbl := NewLBLight(4000, false)
+	err := lbl.Reload(config)
+	assert.Nil(t, err, "Error not expected")
+
+	route := func(req *http.Request) string {
+		router, err := lbl.getBackendRouter(req, &requestInfo{})
+		if err != nil {
+			return ""
+		}
+		return router.Name
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/x", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	assert.Equal(t, "/api", route(req), "Expected path router when no Match applies")
+
+	req.Method = http.MethodPost
+	assert.Equal(t, "writes", route(req))
+
+	req.URL.Path = "/other"
+	assert.Equal(t, "", route(req), "Expected AcceptedPaths to limit the Match router")
+
+	req.Header.Set("X-Canary", "1")
+	assert.Equal(t, "canary", route(req), "Expected higher priority router")
+
+	// same priority, first configured wins.
+	req.RemoteAddr = "192.0.2.10:1234"
+	assert.Equal(t, "canary", route(req))
+	req.Header.Del("X-Canary")
+	assert.Equal(t, "internal", route(req))
+}
+
+func TestRouteMatchValidation(t *testing.T) {
+	config := generateTestConfig("/api")
+	config.BackendRouterConfigs = append(config.BackendRouterConfigs, BackendRouterConfig{Name: "writes", AcceptedPaths: []string{"/api"}, Match: RouteMatchConfig{Methods: []string{"POST"}}})
+	assert.Nil(t, config.Validate(), "Expected Match router to be allowed to overlap")
+
+	config = generateTestConfig("/api")
+	config.BackendRouterConfigs = append(config.BackendRouterConfigs, BackendRouterConfig{Match: RouteMatchConfig{Methods: []string{"POST"}}})
+	assert.NotNil(t, config.Validate(), "Expected error for Match router without a name")
+
+	invalid := []RouteMatchConfig{
+		{PathRegex: "("},
+		{Query: []ParamMatchConfig{{Value: "1"}}},
+		{Headers: []ParamMatchConfig{{Name: "X-A", Value: "1", Regex: "1"}}},
+		{Headers: []ParamMatchConfig{{Name: "X-A", Regex: "["}}},
+		{ClientCIDRs: []string{"10.0.0.0/33"}},
+	}
+	for _, match := range invalid {
+		assert.NotNil(t, match.Validate(), "Expected error for %v", match)
+	}
+}
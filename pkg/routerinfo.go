@@ -0,0 +1,94 @@
+package pkg
+
+import (
+	"sort"
+)
+
+// BackendInfo is a point in time snapshot of a Backend, used for reporting.
+type BackendInfo struct {
+	Host           string `json:"host"`
+	Port           int    `json:"port"`
+	MaxConnections int    `json:"maxconnections"`
+	Weight         int    `json:"weight"`
+	State          string `json:"state"`
+	Alive          bool   `json:"alive"`
+	PoolSize       int    `json:"poolsize"`
+	InFlight       int64  `json:"inflight"`
+
+	SendProxyProtocol bool `json:"sendproxyprotocol,omitempty"`
+
+	// current adaptive concurrency limit, 0 if not enabled.
+	ConcurrencyLimit int `json:"concurrencylimit,omitempty"`
+}
+
+// RouterInfo is a point in time snapshot of a BackendRouter and its Backends, used for reporting.
+type RouterInfo struct {
+	Name            string            `json:"name"`
+	SelectionMethod string            `json:"selectionmethod"`
+	PreserveHost    bool              `json:"preservehost,omitempty"`
+	AcceptedHosts   []string          `json:"acceptedhosts,omitempty"`
+	AcceptedPaths   []string          `json:"acceptedpaths,omitempty"`
+	AcceptedHeaders map[string]string `json:"acceptedheaders,omitempty"`
+	RateLimit       *RateLimitConfig  `json:"ratelimit,omitempty"`
+	Backends        []BackendInfo     `json:"backends"`
+
+	MaxRequestBodyBytes int64  `json:"maxrequestbodybytes,omitempty"`
+	Priority            int    `json:"priority,omitempty"`
+	FallbackRouter      string `json:"fallbackrouter,omitempty"`
+}
+
+// getInfo generates a snapshot of the Backend.
+func (ber *Backend) getInfo() BackendInfo {
+	ber.mux.RLock()
+	defer ber.mux.RUnlock()
+
+	info := BackendInfo{Host: ber.Host, Port: ber.Port, MaxConnections: ber.MaxConnections, Alive: ber.IsAlive()}
+	info.Weight = ber.GetWeight()
+	info.State = ber.GetState().String()
+	info.PoolSize = len(ber.BackendConnections)
+	info.InFlight = ber.InFlight()
+	info.SendProxyProtocol = ber.SendProxyProtocol
+	if ber.concurrency != nil {
+		info.ConcurrencyLimit = ber.concurrency.getLimit()
+	}
+	return info
+}
+
+// getInfo generates a snapshot of the BackendRouter and its Backends.
+func (ber *BackendRouter) getInfo() RouterInfo {
+	info := RouterInfo{Name: ber.Name, SelectionMethod: ber.backendSelectionMethod.String(), PreserveHost: ber.PreserveHost, AcceptedHeaders: ber.acceptedHeaders}
+	info.MaxRequestBodyBytes = ber.MaxRequestBodyBytes
+	info.Priority = ber.Priority
+	if ber.fallback != nil {
+		info.FallbackRouter = ber.fallback.Name
+	}
+	for path := range ber.acceptedPaths {
+		info.AcceptedPaths = append(info.AcceptedPaths, path)
+	}
+	sort.Strings(info.AcceptedPaths)
+
+	for host := range ber.acceptedHosts {
+		info.AcceptedHosts = append(info.AcceptedHosts, host)
+	}
+	sort.Strings(info.AcceptedHosts)
+
+	if ber.rateLimiter != nil {
+		rateLimit := ber.rateLimiter.config
+		info.RateLimit = &rateLimit
+	}
+
+	for _, be := range ber.getBackends() {
+		info.Backends = append(info.Backends, be.getInfo())
+	}
+	return info
+}
+
+// GetRouterInfo returns a snapshot of all the BackendRouters (and their Backends) currently registered,
+// in the order they were configured.
+func (l *LBLight) GetRouterInfo() []RouterInfo {
+	var infos []RouterInfo
+	for _, ber := range l.getRoutingTable().allBackendRouters {
+		infos = append(infos, ber.getInfo())
+	}
+	return infos
+}
@@ -0,0 +1,266 @@
+package pkg
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// routingTable holds the lookups used to map an incoming request to a BackendRouter.
+// Once a routingTable has been handed to LBLight it is treated as read only. Any change (config reload,
+// adding a router) builds a new table and swaps it in, so requests that already hold the old table
+// carry on using it untouched.
+type routingTable struct {
+	// match prefix to appropriate router, for routers that accept any host.
+	pathPrefixToBackendRouter map[string]*BackendRouter
+
+	// match host (exact, or wildcard "*.example.com") then prefix, for routers limited to certain hosts.
+	hostToPathPrefix map[string]map[string]*BackendRouter
+
+	// match header KEY to a potential router
+	headerToBackendRouter map[string]map[string]*BackendRouter
+
+	// routers with a matcher, highest priority first. Checked before the path/host lookups.
+	matchRouters []*BackendRouter
+
+	// used when nothing else matches, nil for a 404.
+	defaultRouter *BackendRouter
+
+	// all BackendRouters.... just single point of reference for stats gathering.
+	allBackendRouters []*BackendRouter
+}
+
+func newRoutingTable() *routingTable {
+	rt := routingTable{}
+	rt.pathPrefixToBackendRouter = make(map[string]*BackendRouter)
+	rt.hostToPathPrefix = make(map[string]map[string]*BackendRouter)
+	rt.headerToBackendRouter = make(map[string]map[string]*BackendRouter)
+	return &rt
+}
+
+// clone makes a copy of the table that can be modified without affecting readers of the original.
+// The BackendRouters themselves are shared.
+func (rt *routingTable) clone() *routingTable {
+	newRT := newRoutingTable()
+	for path, ber := range rt.pathPrefixToBackendRouter {
+		newRT.pathPrefixToBackendRouter[path] = ber
+	}
+
+	for host, paths := range rt.hostToPathPrefix {
+		newPaths := make(map[string]*BackendRouter)
+		for path, ber := range paths {
+			newPaths[path] = ber
+		}
+		newRT.hostToPathPrefix[host] = newPaths
+	}
+
+	for header, values := range rt.headerToBackendRouter {
+		newValues := make(map[string]*BackendRouter)
+		for val, ber := range values {
+			newValues[val] = ber
+		}
+		newRT.headerToBackendRouter[header] = newValues
+	}
+
+	newRT.defaultRouter = rt.defaultRouter
+	newRT.matchRouters = append(newRT.matchRouters, rt.matchRouters...)
+	newRT.allBackendRouters = append(newRT.allBackendRouters, rt.allBackendRouters...)
+	return newRT
+}
+
+func (rt *routingTable) getBackendRouterByExactPathPrefix(path string) (*BackendRouter, error) {
+	lowerPath := strings.ToLower(path)
+	backend, ok := rt.pathPrefixToBackendRouter[lowerPath]
+	if ok {
+		return backend, nil
+	}
+
+	return nil, fmt.Errorf("Unable to find matching backend for path %s", path)
+}
+
+// getBackendRouterByPathPrefix returns the router with the longest prefix of path, out of the routers
+// that accept any host.
+func (rt *routingTable) getBackendRouterByPathPrefix(path string) (*BackendRouter, error) {
+	router := longestPrefixMatch(rt.pathPrefixToBackendRouter, strings.ToLower(path))
+	if router != nil {
+		return router, nil
+	}
+
+	return nil, fmt.Errorf("Unable to find matching backend for path %s", path)
+}
+
+// getBackendRouterByHostAndPath returns the router for the request host and path. Routers for the exact
+// host are checked first, then wildcards (most specific first), then routers that accept any host. Within
+// each the longest matching path prefix wins.
+func (rt *routingTable) getBackendRouterByHostAndPath(host string, path string) (*BackendRouter, error) {
+	lowerPath := strings.ToLower(path)
+	for _, candidate := range hostCandidates(normaliseHost(host)) {
+		paths, ok := rt.hostToPathPrefix[candidate]
+		if !ok {
+			continue
+		}
+		router := longestPrefixMatch(paths, lowerPath)
+		if router != nil {
+			return router, nil
+		}
+	}
+
+	router := longestPrefixMatch(rt.pathPrefixToBackendRouter, lowerPath)
+	if router != nil {
+		return router, nil
+	}
+	return nil, fmt.Errorf("Unable to find matching backend for host %s path %s", host, path)
+}
+
+// getBackendRouterForRequest returns the router for req. Routers with a matcher are tried first, in
+// priority order, then the host/path lookup, then the default router.
+func (rt *routingTable) getBackendRouterForRequest(req *http.Request, clientIP string) (*BackendRouter, error) {
+	router := rt.getMatchRouter(req, clientIP)
+	if router != nil {
+		return router, nil
+	}
+
+	router, err := rt.getBackendRouterByHostAndPath(req.Host, req.URL.Path)
+	if err != nil && rt.defaultRouter != nil {
+		return rt.defaultRouter, nil
+	}
+	return router, err
+}
+
+// longestPrefixMatch returns the router registered for the longest prefix of path, nil if none match.
+func longestPrefixMatch(prefixes map[string]*BackendRouter, path string) *BackendRouter {
+	var match *BackendRouter
+	matchLen := -1
+	for prefix, router := range prefixes {
+		if len(prefix) > matchLen && strings.HasPrefix(path, prefix) {
+			match = router
+			matchLen = len(prefix)
+		}
+	}
+	return match
+}
+
+// normaliseHost lower cases the host and removes any port.
+func normaliseHost(host string) string {
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+// hostCandidates returns the host followed by the wildcards that would match it, most specific first.
+// "a.example.com" gives "a.example.com", "*.example.com", "*.com".
+func hostCandidates(host string) []string {
+	candidates := []string{host}
+	for i := strings.Index(host, "."); i != -1; {
+		candidates = append(candidates, "*"+host[i:])
+		next := strings.Index(host[i+1:], ".")
+		if next == -1 {
+			break
+		}
+		i += next + 1
+	}
+	return candidates
+}
+
+func (rt *routingTable) getBackendRouterByHeader(headerName string, headerValue string) (*BackendRouter, error) {
+
+	headerValues, ok := rt.headerToBackendRouter[headerName]
+	if ok {
+		// have a match for header... now check specific value.
+		headerNameAndValueBackend, ok2 := headerValues[headerValue]
+		if ok2 {
+			return headerNameAndValueBackend, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unable to find matching backend for header %s : %s", headerName, headerValue)
+}
+
+// getBackendRouterByName returns the BackendRouter with the given name.
+func (rt *routingTable) getBackendRouterByName(name string) (*BackendRouter, error) {
+	for _, ber := range rt.allBackendRouters {
+		if ber.Name == name {
+			return ber, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unable to find backend router %s", name)
+}
+
+// addBackendRouter register a BackendRouter to both pathPrefix map and header maps. If any of the
+// paths/headers are already registered then nothing is added and an error is returned.
+// Routers with a matcher can overlap, Priority decides between them.
+func (rt *routingTable) addBackendRouter(ber *BackendRouter) error {
+
+	if ber.matcher != nil {
+		rt.addMatchRouter(ber)
+		rt.allBackendRouters = append(rt.allBackendRouters, ber)
+		return nil
+	}
+
+	// check if path/header already registered.
+	if len(ber.acceptedHosts) > 0 {
+		for host := range ber.acceptedHosts {
+			for path := range ber.getAcceptedPaths() {
+				if _, ok := rt.hostToPathPrefix[host][strings.ToLower(path)]; ok {
+					return fmt.Errorf("Conflict: Backend host %s path %s already registered", host, path)
+				}
+			}
+		}
+	} else if ber.acceptedPaths != nil {
+		for path := range ber.acceptedPaths {
+			_, err := rt.getBackendRouterByExactPathPrefix(path)
+			if err == nil {
+				// no error, we already have something registered!
+				return fmt.Errorf("Conflict: Backend path %s already registered", path)
+			}
+		}
+	}
+
+	// check headers.
+	if ber.acceptedHeaders != nil {
+		for header, val := range ber.acceptedHeaders {
+			_, err2 := rt.getBackendRouterByHeader(header, val)
+			if err2 == nil {
+				// no error, we already have something registered!
+				return fmt.Errorf("Conflict: Backend header %s : %s already registered", header, val)
+			}
+		}
+	}
+
+	// register valid paths/headers
+	if len(ber.acceptedHosts) > 0 {
+		for host := range ber.acceptedHosts {
+			paths, ok := rt.hostToPathPrefix[host]
+			if !ok {
+				paths = make(map[string]*BackendRouter)
+				rt.hostToPathPrefix[host] = paths
+			}
+			for path := range ber.getAcceptedPaths() {
+				paths[strings.ToLower(path)] = ber
+			}
+		}
+	} else if ber.acceptedPaths != nil {
+		for path := range ber.acceptedPaths {
+			rt.pathPrefixToBackendRouter[strings.ToLower(path)] = ber
+		}
+	}
+
+	if ber.acceptedHeaders != nil {
+		for header, val := range ber.acceptedHeaders {
+			specificHeaderMap, ok := rt.headerToBackendRouter[header]
+			if !ok {
+				specificHeaderMap = make(map[string]*BackendRouter)
+				rt.headerToBackendRouter[header] = specificHeaderMap
+			}
+			specificHeaderMap[val] = ber
+		}
+	}
+
+	// list of all backend routers... just for stats.
+	rt.allBackendRouters = append(rt.allBackendRouters, ber)
+	return nil
+}
@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// newServer creates the traffic server and remembers it so Shutdown can stop it. Fails if
+// LBLight is already shutting down.
+func (l *LBLight) newServer() (*http.Server, error) {
+	l.serverMux.Lock()
+	defer l.serverMux.Unlock()
+
+	if l.IsDraining() {
+		return nil, http.ErrServerClosed
+	}
+	l.server = &http.Server{Handler: http.HandlerFunc(l.handleRequestsAndRedirect), MaxHeaderBytes: l.maxHeaderBytes}
+	return l.server, nil
+}
+
+// IsDraining returns true once StartDraining (or Shutdown) has been called.
+func (l *LBLight) IsDraining() bool {
+	return atomic.LoadInt32(&l.draining) == 1
+}
+
+// StartDraining marks LBLight as not ready. Requests are still accepted until Shutdown is called.
+func (l *LBLight) StartDraining() {
+	atomic.StoreInt32(&l.draining, 1)
+}
+
+// InFlight returns the number of client requests currently being handled.
+func (l *LBLight) InFlight() int64 {
+	return atomic.LoadInt64(&l.inFlight)
+}
+
+// Shutdown stops accepting new connections and waits for in-flight requests to complete. If ctx expires
+// first then the remaining connections are closed and ctx's error is returned.
+func (l *LBLight) Shutdown(ctx context.Context) error {
+	l.StartDraining()
+
+	l.serverMux.Lock()
+	server := l.server
+	l.serverMux.Unlock()
+	if server == nil {
+		return nil
+	}
+
+	start := time.Now()
+	inFlight := l.InFlight()
+	log.Infof("Shutting down, waiting for %d in-flight requests", inFlight)
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		aborted := l.InFlight()
+		server.Close()
+		log.Warnf("Shutdown deadline reached after %s, %d of %d in-flight requests aborted", time.Since(start).Round(time.Millisecond), aborted, inFlight)
+		return err
+	}
+
+	log.Infof("Shutdown complete after %s, %d in-flight requests drained", time.Since(start).Round(time.Millisecond), inFlight)
+	return nil
+}
@@ -0,0 +1,121 @@
+package pkg
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startTestTraffic runs ListenAndServeTraffic for lbl on a free local port. Returns the address and
+// a channel that gets ListenAndServeTraffic's result.
+func startTestTraffic(t *testing.T, lbl *LBLight) (string, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "Error not expected")
+	addr := listener.Addr().String()
+	listener.Close()
+
+	lbl.SetListenAddress(addr)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- lbl.ListenAndServeTraffic("", "")
+	}()
+
+	// wait for listener.
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return addr, serveErr
+}
+
+// startBlockingBackend returns a backend that doesn't respond until release is closed. started gets
+// a value as each request arrives.
+func startBlockingBackend() (*httptest.Server, chan struct{}, chan struct{}) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	return backend, started, release
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	backend, started, release := startBlockingBackend()
+	defer backend.Close()
+
+	lbl := generateTestLBLight(t, backend.URL)
+	addr, serveErr := startTestTraffic(t, lbl)
+	assert.Eventually(t, func() bool {
+		_, ready := lbl.Readiness()
+		return ready
+	}, 5*time.Second, 10*time.Millisecond, "Expected ready once serving")
+
+	result := make(chan int, 1)
+	go func() {
+		res, err := http.Get("http://" + addr + "/foo")
+		if err != nil {
+			result <- 0
+			return
+		}
+		res.Body.Close()
+		result <- res.StatusCode
+	}()
+	<-started
+	assert.Equal(t, int64(1), lbl.InFlight())
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- lbl.Shutdown(context.Background())
+	}()
+
+	// listener closed and not ready, but the in-flight request is still going.
+	assert.Nil(t, <-serveErr, "Error not expected")
+	status, ready := lbl.Readiness()
+	assert.False(t, ready)
+	assert.True(t, status.Listener.Draining)
+	_, err := net.Dial("tcp", addr)
+	assert.NotNil(t, err, "Expected new connections to be refused")
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-result)
+	assert.Nil(t, <-shutdownErr, "Error not expected")
+	assert.Equal(t, int64(0), lbl.InFlight())
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	backend, started, release := startBlockingBackend()
+	defer backend.Close()
+	defer close(release)
+
+	lbl := generateTestLBLight(t, backend.URL)
+	addr, serveErr := startTestTraffic(t, lbl)
+
+	go func() {
+		res, err := http.Get("http://" + addr + "/foo")
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := lbl.Shutdown(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Nil(t, <-serveErr, "Error not expected")
+
+	// aborted request should finish up without retrying.
+	for i := 0; i < 100 && lbl.InFlight() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int64(0), lbl.InFlight())
+}
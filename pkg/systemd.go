@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sd_notify states.
+const (
+	SdNotifyReady    string = "READY=1"
+	SdNotifyStopping string = "STOPPING=1"
+	SdNotifyWatchdog string = "WATCHDOG=1"
+)
+
+// systemdListenNames returns the names of the sockets passed by systemd socket activation (LISTEN_FDS),
+// which start at fd 3. Names come from FileDescriptorName= in the socket unit, LBLight uses "traffic"
+// and "admin". Unnamed sockets are matched to listeners by address, except a single unnamed socket which
+// is used for traffic. Returns nil if there are no sockets for this process.
+func systemdListenNames() []string {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil
+	}
+	fdNames := os.Getenv("LISTEN_FDNAMES")
+
+	// not for any processes we start.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var names []string
+	if fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	for i := 0; i < count; i++ {
+		if i >= len(names) {
+			names = append(names, "")
+		}
+		if names[i] == "" || names[i] == "unknown" {
+			names[i] = fmt.Sprintf("fd%d", firstInheritedFD+i)
+		}
+	}
+	names = names[:count]
+
+	if count == 1 && names[0] == fmt.Sprintf("fd%d", firstInheritedFD) {
+		names[0] = trafficListenerName
+	}
+	return names
+}
+
+// SdNotify sends state to systemd's notify socket (NOTIFY_SOCKET). Returns false (and no error) if
+// LBLight isn't running under systemd with Type=notify.
+func SdNotify(state string) (bool, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return false, nil
+	}
+
+	// @ means the abstract namespace.
+	if strings.HasPrefix(socketPath, "@") {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SdReadyState is the READY message, including MAINPID so systemd follows a process started by a
+// binary upgrade (requires NotifyAccess=all in the service unit).
+func SdReadyState() string {
+	return fmt.Sprintf("%s\nMAINPID=%d", SdNotifyReady, os.Getpid())
+}
+
+// SdWatchdogInterval returns how often to send WATCHDOG=1, half the WatchdogSec= of the service unit.
+// Returns 0 if the watchdog isn't enabled for this process.
+func SdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,129 @@
+//go:build !windows
+// +build !windows
+
+package pkg
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestSystemdListenerHelper is run by TestSystemdSocketActivation as the process systemd started.
+func TestSystemdListenerHelper(t *testing.T) {
+	if os.Getenv("LBLIGHT_TEST_SYSTEMD_HELPER") == "" {
+		return
+	}
+
+	// systemd sets LISTEN_PID after forking, so the helper has to do it.
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	ls := newListenerSet()
+
+	// socket unit decides the address, not the config.
+	listener, err := ls.listen(trafficListenerName, ":1")
+	if err != nil {
+		os.Exit(1)
+	}
+
+	served := make(chan struct{})
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "systemd %s", os.Getenv("LISTEN_FDS"))
+		close(served)
+	}))
+	<-served
+	listener.Close()
+	os.Exit(0)
+}
+
+func TestSystemdSocketActivation(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "Error not expected")
+	file, err := listener.(*net.TCPListener).File()
+	assert.Nil(t, err, "Error not expected")
+
+	cmd := exec.Command(os.Args[0], "-test.run", "^TestSystemdListenerHelper$")
+	cmd.Env = append(os.Environ(), "LBLIGHT_TEST_SYSTEMD_HELPER=1", "LISTEN_FDS=1", "LISTEN_FDNAMES=traffic")
+	cmd.ExtraFiles = []*os.File{file}
+	err = cmd.Start()
+	assert.Nil(t, err, "Error not expected")
+	file.Close()
+	listener.Close()
+
+	res, err := http.Get("http://" + listener.Addr().String())
+	assert.Nil(t, err, "Error not expected")
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	// LISTEN_* are cleared once used.
+	assert.Equal(t, "systemd ", string(body))
+	assert.Nil(t, cmd.Wait(), "Error not expected")
+}
+
+func TestSystemdListenNames(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	assert.Equal(t, []string{trafficListenerName}, systemdListenNames())
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "3")
+	os.Setenv("LISTEN_FDNAMES", "admin:unknown")
+	assert.Equal(t, []string{"admin", "fd4", "fd5"}, systemdListenNames())
+
+	// for another process.
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+	assert.Nil(t, systemdListenNames())
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+}
+
+func TestSdNotify(t *testing.T) {
+	sent, err := SdNotify(SdNotifyReady)
+	assert.Nil(t, err, "Error not expected")
+	assert.False(t, sent, "Nothing should be sent without NOTIFY_SOCKET")
+
+	dir, err := ioutil.TempDir("", "lblight")
+	assert.Nil(t, err, "Error not expected")
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	assert.Nil(t, err, "Error not expected")
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socketPath)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	for _, state := range []string{SdReadyState(), SdNotifyWatchdog, SdNotifyStopping} {
+		sent, err = SdNotify(state)
+		assert.Nil(t, err, "Error not expected")
+		assert.True(t, sent, "Expected notification to be sent")
+
+		buf := make([]byte, 256)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		assert.Nil(t, err, "Error not expected")
+		assert.Equal(t, state, string(buf[:n]))
+	}
+	assert.Equal(t, fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()), SdReadyState())
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	assert.Equal(t, time.Duration(0), SdWatchdogInterval())
+
+	os.Setenv("WATCHDOG_USEC", "2000000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	assert.Equal(t, time.Second, SdWatchdogInterval())
+
+	os.Setenv("WATCHDOG_PID", "1")
+	defer os.Unsetenv("WATCHDOG_PID")
+	assert.Equal(t, time.Duration(0), SdWatchdogInterval(), "Watchdog is for another process")
+}
@@ -0,0 +1,169 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+)
+
+const (
+	tracerName string = "github.com/kpfaulkner/lblight"
+)
+
+// traceContextPropagator reads/writes the W3C traceparent and tracestate headers.
+var traceContextPropagator = propagation.TraceContext{}
+
+// TracingConfig configures exporting of traces with OTLP over HTTP.
+type TracingConfig struct {
+	// host:port of the OTLP/HTTP collector (eg. localhost:4318). Empty disables tracing.
+	Endpoint string `json:"endpoint"`
+
+	// path on the collector, defaults to /v1/traces.
+	URLPath string `json:"urlpath,omitempty"`
+
+	// use http instead of https to talk to the collector.
+	Insecure bool `json:"insecure,omitempty"`
+
+	// service.name reported for the spans, defaults to lblight.
+	ServiceName string `json:"servicename,omitempty"`
+
+	// fraction (0-1) of new traces to sample. 0 (not set) samples everything. Requests that
+	// arrive with a traceparent follow the caller's sampling decision.
+	SampleRate float64 `json:"samplerate,omitempty"`
+}
+
+// Validate checks the tracing config.
+func (c TracingConfig) Validate() error {
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("Tracing samplerate must be between 0 and 1")
+	}
+	return nil
+}
+
+// NewTracerProvider creates a TracerProvider that exports spans to the OTLP collector in config.
+// Returns nil (and no error) if tracing is not configured. The caller should Shutdown the provider
+// on exit so any buffered spans are sent.
+func NewTracerProvider(config TracingConfig) (*sdktrace.TracerProvider, error) {
+	if config.Endpoint == "" {
+		return nil, nil
+	}
+
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint)}
+	if config.URLPath != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(config.URLPath))
+	}
+	if config.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = "lblight"
+	}
+
+	sampleRate := config.SampleRate
+	if sampleRate == 0 {
+		sampleRate = 1
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRate))),
+	)
+	return tp, nil
+}
+
+// startServerSpan starts the span covering the whole request through LBLight. If the request has a
+// traceparent header then the span is a child of the caller's span.
+func startServerSpan(tracer trace.Tracer, req *http.Request) (*http.Request, trace.Span) {
+	ctx := traceContextPropagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := tracer.Start(ctx, fmt.Sprintf("HTTP %s", req.Method), trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("lblight", "", req)...),
+		trace.WithAttributes(semconv.NetAttributesFromHTTPRequest("tcp", req)...))
+	return req.WithContext(ctx), span
+}
+
+// endServerSpan records the outcome of the request on the span and ends it.
+func endServerSpan(span trace.Span, req *http.Request, info *requestInfo, status int) {
+	if info.router != nil {
+		span.SetName(fmt.Sprintf("HTTP %s %s", req.Method, info.router.Name))
+	}
+	span.SetAttributes(
+		attribute.String("lblight.request_id", info.requestID),
+		attribute.String("lblight.router", info.routerName()),
+		attribute.String("lblight.backend", info.backendHost()),
+		attribute.Int("lblight.retries", info.retries))
+	span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(status, trace.SpanKindServer))
+	span.End()
+}
+
+// tracingTransport creates a client span for every request sent to a backend (so each retry gets its
+// own span) and passes the span context on to the backend in the traceparent/tracestate headers.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (tt *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parent := trace.SpanFromContext(req.Context())
+	tracer := parent.TracerProvider().Tracer(tracerName)
+	ctx, span := tracer.Start(req.Context(), fmt.Sprintf("HTTP %s %s", req.Method, req.URL.Host), trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPClientAttributesFromHTTPRequest(req)...),
+		trace.WithAttributes(attribute.Int("lblight.attempt", GetRetryFromContext(req)+1)))
+
+	// RoundTrippers shouldn't modify the request they're given.
+	req = req.Clone(ctx)
+	traceContextPropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := tt.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return nil, err
+	}
+
+	span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(resp.StatusCode)...)
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(resp.StatusCode, trace.SpanKindClient))
+
+	// span covers the body being streamed back as well, so end it when the body is closed.
+	// Upgraded (websocket) connections need the original body, since it's read/written directly.
+	if resp.Body == nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		span.End()
+	} else {
+		resp.Body = &spanEndingBody{ReadCloser: resp.Body, span: span}
+	}
+	return resp, nil
+}
+
+// spanEndingBody ends the span when the response body is closed.
+type spanEndingBody struct {
+	io.ReadCloser
+	span trace.Span
+}
+
+func (sb *spanEndingBody) Close() error {
+	err := sb.ReadCloser.Close()
+	sb.span.End()
+	return err
+}
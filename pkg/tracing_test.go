@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"compress/gzip"
+	"context"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// newTestCollector starts an OTLP/HTTP collector that passes every export request it gets to received.
+func newTestCollector(t *testing.T, received chan<- *coltracepb.ExportTraceServiceRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			assert.Nil(t, err, "Error not expected")
+			body = gz
+		}
+		data, err := ioutil.ReadAll(body)
+		assert.Nil(t, err, "Error not expected")
+
+		export := &coltracepb.ExportTraceServiceRequest{}
+		err = proto.Unmarshal(data, export)
+		assert.Nil(t, err, "Error not expected")
+		received <- export
+
+		response, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(response)
+	}))
+}
+
+// otlpAttributes returns the string attributes as a map.
+func otlpAttributes(attributes []*commonpb.KeyValue) map[string]string {
+	values := make(map[string]string)
+	for _, kv := range attributes {
+		values[kv.Key] = kv.Value.GetStringValue()
+	}
+	return values
+}
+
+func TestTracingCreatesServerAndBackendSpans(t *testing.T) {
+	var traceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer backend.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	lbl := generateTestLBLight(t, backend.URL)
+	lbl.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	// caller's trace should be continued.
+	callerTraceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/foo/bar", nil)
+	req.Header.Set("traceparent", "00-"+callerTraceID+"-00f067aa0ba902b7-01")
+	lbl.handleRequestsAndRedirect(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	assert.Equal(t, 2, len(spans), "Expected server and backend spans")
+
+	var server, client sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		switch span.SpanKind() {
+		case trace.SpanKindServer:
+			server = span
+		case trace.SpanKindClient:
+			client = span
+		}
+	}
+	assert.NotNil(t, server, "Expected server span")
+	assert.NotNil(t, client, "Expected backend span")
+
+	assert.Equal(t, "HTTP GET /foo", server.Name())
+	assert.Equal(t, callerTraceID, server.SpanContext().TraceID().String())
+	assert.Equal(t, server.SpanContext().SpanID(), client.Parent().SpanID())
+
+	// backend should get the backend span as its parent.
+	assert.Equal(t, "00-"+callerTraceID+"-"+client.SpanContext().SpanID().String()+"-01", traceparent)
+}
+
+func TestTracingExportsToCollector(t *testing.T) {
+	received := make(chan *coltracepb.ExportTraceServiceRequest, 10)
+	collector := newTestCollector(t, received)
+	defer collector.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	collectorURL, _ := url.Parse(collector.URL)
+	tp, err := NewTracerProvider(TracingConfig{Endpoint: collectorURL.Host, Insecure: true, ServiceName: "lblight-test"})
+	assert.Nil(t, err, "Error not expected")
+
+	lbl := generateTestLBLight(t, backend.URL)
+	lbl.SetTracerProvider(tp)
+	req := httptest.NewRequest(http.MethodGet, "/foo/bar", nil)
+	req.Header.Set(RequestIDHeader, "abc")
+	lbl.handleRequestsAndRedirect(httptest.NewRecorder(), req)
+
+	// flushes the batched spans to the collector.
+	err = tp.Shutdown(context.Background())
+	assert.Nil(t, err, "Error not expected")
+	close(received)
+
+	found := false
+	for export := range received {
+		for _, resourceSpans := range export.ResourceSpans {
+			assert.Equal(t, "lblight-test", otlpAttributes(resourceSpans.Resource.Attributes)["service.name"])
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				for _, span := range scopeSpans.Spans {
+					if span.Name != "HTTP GET /foo" {
+						continue
+					}
+					found = true
+					attributes := otlpAttributes(span.Attributes)
+					assert.Equal(t, "abc", attributes["lblight.request_id"])
+					assert.Equal(t, "/foo", attributes["lblight.router"])
+					assert.Equal(t, backend.URL, attributes["lblight.backend"])
+				}
+			}
+		}
+	}
+	assert.True(t, found, "Expected server span at the collector")
+}
+
+func TestTracingConfigValidation(t *testing.T) {
+	assert.NotNil(t, TracingConfig{Endpoint: "localhost:4318", SampleRate: 2}.Validate(), "Expected samplerate error")
+
+	tp, err := NewTracerProvider(TracingConfig{})
+	assert.Nil(t, err, "Error not expected")
+	assert.Nil(t, tp, "No provider expected when no endpoint configured")
+}
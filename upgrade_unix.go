@@ -0,0 +1,112 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"github.com/kpfaulkner/lblight/pkg"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// upgradeParentEnv tells a process started by SIGUSR2 which process to tell once it has taken over.
+const upgradeParentEnv = "LBLIGHT_UPGRADE_PARENT_PID"
+
+// watchUpgrade starts a new lblight process whenever SIGUSR2 is received, handing it the listening sockets.
+// Once the new process is up it sends this one SIGTERM, so this one drains and exits as normal. Used to
+// upgrade the binary without refusing any connections: replace the binary then send SIGUSR2.
+func watchUpgrade(lbl *pkg.LBLight) {
+	sigusr2 := make(chan os.Signal, 1)
+	signal.Notify(sigusr2, syscall.SIGUSR2)
+
+	for range sigusr2 {
+		if lbl.IsDraining() {
+			log.Warnf("SIGUSR2 received while shutting down, ignoring")
+			continue
+		}
+
+		log.Infof("SIGUSR2 received, starting new process")
+		err := startUpgrade()
+		if err != nil {
+			log.Errorf("Unable to start new process, carrying on: %s", err.Error())
+		}
+	}
+}
+
+// startUpgrade starts the new process with the same command line, passing it the listening sockets.
+func startUpgrade() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	files, names, err := pkg.ListenerFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	// WATCHDOG_PID is this process, the new one needs to send watchdog messages too once it takes over.
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			env = append(env, kv)
+		}
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(env, fmt.Sprintf("%s=%s", pkg.InheritedListenersEnv, names), fmt.Sprintf("%s=%d", upgradeParentEnv, os.Getpid()))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	log.Infof("Started new process %d with listeners %s", cmd.Process.Pid, names)
+
+	// if it exits while we're still running then it failed to start (eg. bad config).
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			log.Errorf("New process %d exited: %s", cmd.Process.Pid, err.Error())
+			return
+		}
+		log.Warnf("New process %d exited", cmd.Process.Pid)
+	}()
+	return nil
+}
+
+// notifyUpgradeParent tells the process that started this one (with SIGUSR2) that the listeners have
+// been taken over, so it can drain and exit.
+func notifyUpgradeParent() {
+	pidStr := os.Getenv(upgradeParentEnv)
+	if pidStr == "" {
+		return
+	}
+	os.Unsetenv(upgradeParentEnv)
+
+	// only if it's still our parent, don't want to SIGTERM some random process.
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil || pid != os.Getppid() {
+		log.Warnf("Process %s that started this one has gone, not notifying it", pidStr)
+		return
+	}
+
+	log.Infof("Listeners taken over, telling process %d to shut down", pid)
+	err = syscall.Kill(pid, syscall.SIGTERM)
+	if err != nil {
+		log.Errorf("Unable to notify process %d : %s", pid, err.Error())
+	}
+}
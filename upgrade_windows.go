@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"github.com/kpfaulkner/lblight/pkg"
+)
+
+// watchUpgrade does nothing, listener handoff isn't supported on Windows.
+func watchUpgrade(lbl *pkg.LBLight) {
+}
+
+// notifyUpgradeParent does nothing, listener handoff isn't supported on Windows.
+func notifyUpgradeParent() {
+}